@@ -0,0 +1,3 @@
+module github.com/pdxiv/goteststuff
+
+go 1.24
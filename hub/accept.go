@@ -0,0 +1,181 @@
+package hub
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Bounds for the delay before retrying after a temporary Accept error
+const (
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+)
+
+// checkForNewIncomingConnections hands connections accepted by listener to
+// the hub, as sessions speaking protocol p. Accept errors that are likely to
+// clear up, such as running out of file descriptors, are retried with
+// exponential backoff. Any other error shuts the server down.
+func (h *Hub) checkForNewIncomingConnections(listener net.Listener, p protocol) {
+	backoff := time.Duration(0)
+	for {
+		connection, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return // The server is shutting down
+		}
+		if err != nil && isTemporaryAcceptError(err) {
+			if backoff == 0 {
+				backoff = minAcceptBackoff
+			} else if backoff *= 2; backoff > maxAcceptBackoff {
+				backoff = maxAcceptBackoff
+			}
+			h.stats.temporaryAcceptErrors.Add(1)
+			log.Printf("Accept error: %v; retrying in %v (%d temporary accept errors in total)",
+				err, backoff, h.stats.temporaryAcceptErrors.Load())
+			time.Sleep(backoff)
+			continue
+		}
+		if err != nil {
+			h.stats.permanentAcceptErrors.Add(1)
+			log.Printf("Accept error: %v; shutting down (%d permanent accept errors in total)",
+				err, h.stats.permanentAcceptErrors.Load())
+			h.requestStop()
+			return
+		}
+		backoff = 0
+		if ban := h.bans.matchAddress(remoteAddress(connection.RemoteAddr())); ban != nil {
+			go rejectConnection(NewStreamTransport(connection, h.cfg.MaxLineLength), p, "you are banned"+ban.describeReason())
+			continue
+		}
+		release, limit := h.countConnection(connection.RemoteAddr())
+		if limit != "" {
+			go rejectConnection(NewStreamTransport(connection, h.cfg.MaxLineLength), p, limitReasons[limit])
+			continue
+		}
+		go h.admitConnection(connection, p, release)
+	}
+}
+
+// admitConnection completes the TLS handshake with a client connecting over
+// TLS, then admits it like any other transport. This runs in a goroutine of
+// its own, so a client that is slow to complete the handshake cannot hold up
+// anybody else. release stops counting the client against the connection
+// limits.
+func (h *Hub) admitConnection(connection net.Conn, p protocol, release func()) {
+	var verifiedNick string
+	if tlsConnection, ok := connection.(*tls.Conn); ok {
+		_ = connection.SetDeadline(time.Now().Add(time.Duration(h.cfg.HandshakeTimeout)))
+		if err := tlsConnection.Handshake(); err != nil {
+			log.Printf("TLS handshake with %v failed: %v", connection.RemoteAddr(), err)
+			_ = connection.Close()
+			release()
+			return
+		}
+		_ = connection.SetDeadline(time.Time{})
+		verifiedNick = certificateNick(tlsConnection.ConnectionState())
+	}
+	transport := NewStreamTransport(connection, h.cfg.MaxLineLength)
+	h.admit(&limitedTransport{Transport: transport, release: release}, p, verifiedNick)
+}
+
+// Attach makes a client connected over some other transport than the hub's
+// own listener a session, just as if it had connected to the listener. The
+// hub takes ownership of the transport, and closes it when the session ends.
+// The client speaks the plain text protocol. Attach returns at once; logging
+// in, if needed, happens in the background.
+func (h *Hub) Attach(transport Transport) {
+	h.attach(transport, textProtocol{}, "")
+}
+
+// attach turns a client away if it is banned or over a connection limit, and
+// admits it in the background otherwise.
+func (h *Hub) attach(transport Transport, p protocol, verifiedNick string) {
+	if ban := h.bans.matchAddress(remoteAddress(transport.RemoteAddr())); ban != nil {
+		go rejectConnection(transport, p, "you are banned"+ban.describeReason())
+		return
+	}
+	release, limit := h.countConnection(transport.RemoteAddr())
+	if limit != "" {
+		go rejectConnection(transport, p, limitReasons[limit])
+		return
+	}
+	go h.admit(&limitedTransport{Transport: transport, release: release}, p, verifiedNick)
+}
+
+// admit lets the protocol greet a client, logging it in if needed, and hands
+// it to the hub to become a session.
+func (h *Hub) admit(transport Transport, p protocol, verifiedNick string) {
+	admitted := newConnection{transport: transport, protocol: p, nick: verifiedNick}
+	setDeadline(transport, time.Now().Add(time.Duration(h.cfg.LoginTimeout)))
+	if err := p.greet(h, &admitted); err != nil {
+		log.Printf("Login from %v failed: %v", transport.RemoteAddr(), err)
+		rejectConnection(transport, p, "login failed, goodbye")
+		return
+	}
+	setDeadline(transport, time.Time{})
+	select {
+	case h.newConnections <- admitted:
+	case <-h.done:
+		_ = transport.Close()
+	}
+}
+
+// setDeadline sets both the read and the write deadline of a transport.
+func setDeadline(transport Transport, deadline time.Time) {
+	_ = transport.SetReadDeadline(deadline)
+	_ = transport.SetWriteDeadline(deadline)
+}
+
+// Number of tries a client gets to log in before it is disconnected
+const loginAttempts = 3
+
+// login asks a client for its username and password, and returns the
+// username once the client has got them right.
+func (h *Hub) login(transport Transport) (string, error) {
+	prompt := func(text string) (string, error) {
+		if err := transport.Write([]byte(text)); err != nil {
+			return "", err
+		}
+		line, err := transport.ReadLine()
+		return strings.TrimSuffix(string(line), "\n"), err
+	}
+	var err error
+	for attempt := 0; attempt < loginAttempts; attempt++ {
+		var user, password string
+		if user, err = prompt("Username: "); err != nil {
+			return "", err
+		}
+		if password, err = prompt("Password: "); err != nil {
+			return "", err
+		}
+		if err = h.auth.authenticate(user, password); err == nil {
+			return user, nil
+		}
+		log.Printf("Login as %q from %v failed: %v", user, transport.RemoteAddr(), err)
+		if err := transport.Write([]byte("Error: " + err.Error() + "\n")); err != nil {
+			return "", err
+		}
+	}
+	return "", err
+}
+
+// isTemporaryAcceptError reports whether an Accept error is worth retrying.
+func isTemporaryAcceptError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	for _, temporary := range []syscall.Errno{
+		syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM,
+		syscall.ECONNABORTED, syscall.ECONNRESET, syscall.EINTR, syscall.EAGAIN,
+	} {
+		if errors.Is(err, temporary) {
+			return true
+		}
+	}
+	return false
+}
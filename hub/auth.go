@@ -0,0 +1,233 @@
+package hub
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errBadCredentials = errors.New("wrong username or password")
+	errLockedOut      = errors.New("too many failed logins, try again later")
+)
+
+// authenticator checks usernames and passwords against a credentials file,
+// and locks accounts that fail to log in too often. It is used by several
+// goroutines at once.
+type authenticator struct {
+	file        string
+	maxFailures int
+	lockout     time.Duration
+
+	mutex    sync.Mutex
+	failures map[string]*loginFailures // By username
+}
+
+// loginFailures tracks the failed logins of one account.
+type loginFailures struct {
+	count       int // Failures in a row
+	lockedUntil time.Time
+}
+
+func newAuthenticator(cfg Config) *authenticator {
+	return &authenticator{
+		file:        cfg.AuthFile,
+		maxFailures: cfg.AuthMaxFailures,
+		lockout:     time.Duration(cfg.AuthLockout),
+		failures:    make(map[string]*loginFailures),
+	}
+}
+
+// authenticate checks a username and password. The credentials file is read
+// every time, so accounts can be managed while the server is running.
+func (a *authenticator) authenticate(user, password string) error {
+	a.mutex.Lock()
+	failures := a.failures[user]
+	if failures != nil && time.Now().Before(failures.lockedUntil) {
+		a.mutex.Unlock()
+		return errLockedOut
+	}
+	a.mutex.Unlock()
+
+	credentials, err := readCredentials(a.file)
+	if err != nil {
+		log.Print("Failed to read credentials: ", err)
+		return errBadCredentials
+	}
+	stored, known := credentials[user]
+	if !known {
+		// Take as long as for a real account, to not give away which exist
+		stored = credential{salt: make([]byte, saltSize), iterations: passwordIterations}
+	}
+	ok := stored.matches(password) && known
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if ok {
+		delete(a.failures, user)
+		return nil
+	}
+	if a.failures[user] == nil {
+		a.failures[user] = &loginFailures{}
+	}
+	failures = a.failures[user]
+	failures.count++
+	if a.maxFailures > 0 && failures.count >= a.maxFailures {
+		failures.count = 0
+		failures.lockedUntil = time.Now().Add(a.lockout)
+		log.Printf("Locking account %q for %v after %d failed logins", user, a.lockout, a.maxFailures)
+	}
+	return errBadCredentials
+}
+
+// Parameters for new password hashes
+const (
+	saltSize           = 16
+	passwordIterations = 600000
+	passwordHashSize   = 32
+)
+
+// credential is a salted PBKDF2-SHA256 password hash.
+type credential struct {
+	salt       []byte
+	iterations int
+	hash       []byte
+}
+
+func newCredential(password string) (credential, error) {
+	c := credential{salt: make([]byte, saltSize), iterations: passwordIterations}
+	if _, err := rand.Read(c.salt); err != nil {
+		return c, err
+	}
+	var err error
+	c.hash, err = pbkdf2.Key(sha256.New, password, c.salt, c.iterations, passwordHashSize)
+	return c, err
+}
+
+func (c credential) matches(password string) bool {
+	hash, err := pbkdf2.Key(sha256.New, password, c.salt, c.iterations, passwordHashSize)
+	return err == nil && subtle.ConstantTimeCompare(hash, c.hash) == 1
+}
+
+// readCredentials reads a credentials file. Each line holds a username and
+// its password hash as "name:pbkdf2-sha256:iterations:salt:hash", with the
+// salt and hash in base64. A missing file holds no credentials.
+func readCredentials(name string) (map[string]credential, error) {
+	credentials := make(map[string]credential)
+	content, err := os.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return credentials, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for number, line := range strings.Split(string(content), "\n") {
+		if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, c, err := parseCredential(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", name, number+1, err)
+		}
+		credentials[user] = c
+	}
+	return credentials, nil
+}
+
+// parseCredential parses a line of a credentials file.
+func parseCredential(line string) (string, credential, error) {
+	var c credential
+	fields := strings.Split(line, ":")
+	if len(fields) != 5 || fields[1] != "pbkdf2-sha256" {
+		return "", c, errors.New("malformed credentials")
+	}
+	var err error
+	if c.iterations, err = strconv.Atoi(fields[2]); err != nil {
+		return "", c, err
+	}
+	if c.salt, err = base64.StdEncoding.DecodeString(fields[3]); err != nil {
+		return "", c, err
+	}
+	if c.hash, err = base64.StdEncoding.DecodeString(fields[4]); err != nil {
+		return "", c, err
+	}
+	return fields[0], c, nil
+}
+
+// writeCredentials replaces a credentials file. The new contents are written
+// to a temporary file first, so the server never sees a half-written file.
+func writeCredentials(name string, credentials map[string]credential) error {
+	users := make([]string, 0, len(credentials))
+	for user := range credentials {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	var content strings.Builder
+	for _, user := range users {
+		c := credentials[user]
+		fmt.Fprintf(&content, "%s:pbkdf2-sha256:%d:%s:%s\n", user, c.iterations,
+			base64.StdEncoding.EncodeToString(c.salt), base64.StdEncoding.EncodeToString(c.hash))
+	}
+	temporary := name + ".tmp"
+	if err := os.WriteFile(temporary, []byte(content.String()), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(temporary, name)
+}
+
+// SetPassword adds an account to a credentials file, or changes the password
+// of an account that is already there.
+func SetPassword(file, user, password string) error {
+	if !nickPattern.MatchString(user) {
+		return errors.New("a username is 1 to 16 letters, digits, '_' or '-', starting with a letter")
+	}
+	if password == "" {
+		return errors.New("the password must not be empty")
+	}
+	credentials, err := readCredentials(file)
+	if err != nil {
+		return err
+	}
+	if credentials[user], err = newCredential(password); err != nil {
+		return err
+	}
+	return writeCredentials(file, credentials)
+}
+
+// RemoveUser removes an account from a credentials file.
+func RemoveUser(file, user string) error {
+	credentials, err := readCredentials(file)
+	if err != nil {
+		return err
+	}
+	if _, ok := credentials[user]; !ok {
+		return fmt.Errorf("there is no user %q", user)
+	}
+	delete(credentials, user)
+	return writeCredentials(file, credentials)
+}
+
+// Users returns the accounts in a credentials file, sorted by name.
+func Users(file string) ([]string, error) {
+	credentials, err := readCredentials(file)
+	if err != nil {
+		return nil, err
+	}
+	users := make([]string, 0, len(credentials))
+	for user := range credentials {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	return users, nil
+}
@@ -0,0 +1,192 @@
+package hub
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// isCommand reports whether a line is a command rather than a message.
+func isCommand(line []byte) bool {
+	return len(line) > 0 && line[0] == '/'
+}
+
+// parseCommand splits a command line into its upper-cased name and its
+// arguments.
+func parseCommand(line []byte) (string, []string) {
+	fields := strings.Fields(string(line[1:]))
+	if len(fields) == 0 {
+		return "", nil
+	}
+	return strings.ToUpper(fields[0]), fields[1:]
+}
+
+// commandRest returns what follows the first n fields of a command line, with
+// its spacing intact.
+func commandRest(line []byte, n int) string {
+	rest := strings.TrimSpace(string(line[1:]))
+	for i := 0; i < n; i++ {
+		end := strings.IndexAny(rest, " \t")
+		if end < 0 {
+			return ""
+		}
+		rest = strings.TrimLeft(rest[end:], " \t")
+	}
+	return rest
+}
+
+// handleCommand carries out a command sent by a session.
+func (h *Hub) handleCommand(sender *session, line []byte) {
+	name, args := parseCommand(line)
+	switch name {
+	case "JOIN", "PART":
+		if len(args) != 1 {
+			h.reply(sender, "Usage: /"+name+" <room>")
+			return
+		}
+		room, ok := normalizeRoomName(args[0])
+		if !ok {
+			h.fail(sender, 403, args[0], "invalid room name "+args[0])
+			return
+		}
+		if name == "JOIN" {
+			h.joinRoom(sender, room)
+		} else {
+			h.partRoom(sender, room)
+		}
+	case "LIST":
+		h.listRooms(sender)
+	case "NAMES":
+		h.namesCommand(sender, args)
+	case "NICK":
+		if len(args) == 0 {
+			h.reply(sender, "* you are known as "+sender.nick)
+			return
+		}
+		if h.auth != nil {
+			// Everyone has logged in, and goes by the name they logged in with
+			h.reply(sender, "Error: your nick is your username")
+			return
+		}
+		if len(args) != 1 || !nickPattern.MatchString(args[0]) {
+			h.fail(sender, 432, strings.Join(args, " "), "a nick is 1 to 16 letters, digits, '_' or '-', starting with a letter")
+			return
+		}
+		h.changeNick(sender, args[0])
+	case "HISTORY":
+		h.historyCommand(sender, args)
+	case "MSG":
+		text := commandRest(line, 2)
+		if len(args) < 2 || text == "" {
+			h.reply(sender, "Usage: /MSG <nick> <text>")
+			return
+		}
+		h.privateMessage(sender, args[0], []byte(text+"\n"))
+	case "SUB":
+		h.subscribeCommand(sender, args)
+	case "UNSUB":
+		h.unsubscribeCommand(sender, args)
+	case "PUB":
+		text := commandRest(line, 2)
+		if len(args) < 2 || text == "" {
+			h.reply(sender, "Usage: /PUB <topic> <text>")
+			return
+		}
+		if !validTopic(args[0], false) {
+			h.reply(sender, "Error: a topic is levels separated by '/', without wildcards")
+			return
+		}
+		h.publishTopic(sender, args[0], []byte(text+"\n"))
+	case "PONG":
+		h.pongCommand(sender, args)
+	case "OPER":
+		h.operCommand(sender, args)
+	case "KICK", "BAN", "UNBAN", "BANS", "MUTE", "UNMUTE":
+		if !sender.operator {
+			h.reply(sender, "Error: only operators may use /"+name)
+			return
+		}
+		h.moderatorCommand(sender, name, args, line)
+	default:
+		h.fail(sender, 421, name, "unknown command /"+name)
+	}
+}
+
+// privateMessage delivers a message to the session going by nick, and no one
+// else.
+func (h *Hub) privateMessage(sender *session, nick string, message []byte) {
+	if h.isMuted(sender) {
+		return
+	}
+	recipient := h.nicks[strings.ToLower(nick)]
+	if recipient == nil {
+		h.fail(sender, 401, nick, "there is no one called "+nick+" here")
+		return
+	}
+	message, ok := h.filter(sender, message)
+	if !ok {
+		return
+	}
+	text := strings.TrimSuffix(string(message), "\n")
+	h.send(recipient, event{kind: eventPrivate, sender: sender.nick, text: text, notice: h.notice})
+	h.send(sender, event{kind: eventSent, sender: sender.nick, target: recipient.nick, text: text})
+}
+
+// namesCommand handles "/NAMES [room...]", which tells who is in each room
+// given, or in each of the sender's rooms if none are given.
+func (h *Hub) namesCommand(sender *session, args []string) {
+	if len(args) == 0 {
+		for room := range sender.rooms {
+			args = append(args, room)
+		}
+		sort.Strings(args)
+	}
+	for _, arg := range args {
+		room, ok := normalizeRoomName(arg)
+		if !ok {
+			h.fail(sender, 403, arg, "invalid room name "+arg)
+			continue
+		}
+		h.send(sender, event{kind: eventNames, room: room, names: h.roomNames(room)})
+	}
+}
+
+// historyCommand handles "/HISTORY [room] [page]". The room may be left out by
+// sessions that are in a single room. Page 1 holds the most recent messages.
+func (h *Hub) historyCommand(sender *session, args []string) {
+	const usage = "Usage: /HISTORY [room] [page]"
+	page := 1
+	if len(args) > 0 {
+		if number, err := strconv.Atoi(args[len(args)-1]); err == nil {
+			if number < 1 {
+				h.reply(sender, usage)
+				return
+			}
+			page = number
+			args = args[:len(args)-1]
+		}
+	}
+	var room string
+	switch {
+	case len(args) == 1:
+		var ok bool
+		if room, ok = normalizeRoomName(args[0]); !ok {
+			h.fail(sender, 403, args[0], "invalid room name "+args[0])
+			return
+		}
+	case len(args) == 0 && len(sender.rooms) == 1:
+		for room = range sender.rooms {
+			// Take the only room there is
+		}
+	default:
+		h.reply(sender, usage)
+		return
+	}
+	if !sender.rooms[room] {
+		h.fail(sender, 442, room, "you are not in "+room)
+		return
+	}
+	if !h.replayHistory(sender, room, page) {
+		h.reply(sender, "* there is no more history for "+room)
+	}
+}
@@ -0,0 +1,354 @@
+package hub
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Config holds the tunable settings of the server. It can be read from a JSON
+// file, and every setting can be overridden by a command-line flag.
+type Config struct {
+	ListenAddress           string   `json:"listen_address"`
+	ChannelBufferSize       int      `json:"channel_buffer_size"`        // Capacity of the channels feeding the hub
+	MaxConnections          int      `json:"max_connections"`            // Counting clients still logging in, 0 for no limit
+	MaxConnectionsPerIP     int      `json:"max_connections_per_ip"`     // 0 for no limit
+	MaxConnectionsPerSubnet int      `json:"max_connections_per_subnet"` // 0 for no limit
+	SubnetPrefixIPv4        int      `json:"subnet_prefix_ipv4"`         // Bits of an IPv4 address that make up its subnet
+	SubnetPrefixIPv6        int      `json:"subnet_prefix_ipv6"`         // Bits of an IPv6 address that make up its subnet
+	MaxLineLength           int      `json:"max_line_length"`            // Longest accepted line, not counting the line terminator
+	OutboundQueueSize       int      `json:"outbound_queue_size"`        // Messages that may wait for delivery to one session
+	WriteTimeout            Duration `json:"write_timeout"`              // Longest a single write may block, 0 for no limit
+	PingInterval            Duration `json:"ping_interval"`              // Silence after which a client is pinged, 0 to never ping
+	IdleTimeout             Duration `json:"idle_timeout"`               // Silence after which a client is disconnected, 0 for no limit
+	SlowConsumerPolicy      string   `json:"slow_consumer_policy"`
+	DefaultRoom             string   `json:"default_room"`     // Room new sessions join, empty for none
+	ShutdownNotice          string   `json:"shutdown_notice"`  // Sent to every session when the server shuts down
+	ShutdownTimeout         Duration `json:"shutdown_timeout"` // Longest to wait for outbound queues to drain on shutdown
+	BadWords                WordList `json:"bad_words"`        // Words the word filter looks for
+	BadWordsFile            string   `json:"bad_words_file"`   // File with more bad words, one per line
+	BadWordWarning          string   `json:"bad_word_warning"`
+	FilterMode              string   `json:"filter_mode"`         // What the word filter does about bad words
+	TLSCertFile             string   `json:"tls_cert_file"`       // PEM certificate chain, enables TLS
+	TLSKeyFile              string   `json:"tls_key_file"`        // PEM private key for TLSCertFile
+	TLSClientCAFile         string   `json:"tls_client_ca_file"`  // PEM CAs for client certificates, enables mTLS
+	TLSSelfSigned           bool     `json:"tls_self_signed"`     // Enables TLS with a throwaway certificate
+	HandshakeTimeout        Duration `json:"handshake_timeout"`   // Longest a client may take to get through the TLS handshake
+	AuthFile                string   `json:"auth_file"`           // Credentials clients must log in with, empty to not require login
+	AuthMaxFailures         int      `json:"auth_max_failures"`   // Failed logins in a row before an account is locked
+	AuthLockout             Duration `json:"auth_lockout"`        // How long an account stays locked
+	LoginTimeout            Duration `json:"login_timeout"`       // Longest a client may take to log in
+	Operators               WordList `json:"operators"`           // Accounts that are operators as soon as they connect
+	OperatorPassword        string   `json:"operator_password"`   // Password for OPER, empty to disable OPER
+	BanFile                 string   `json:"ban_file"`            // Where bans are kept, empty to forget them on restart
+	MetricsAddress          string   `json:"metrics_address"`     // Where to serve Prometheus metrics over HTTP, empty for nowhere
+	IRCListenAddress        string   `json:"irc_listen_address"`  // Where to accept IRC clients, empty for nowhere
+	WebListenAddress        string   `json:"web_listen_address"`  // Where to serve the web page and WebSocket, empty for nowhere
+	HistorySize             int      `json:"history_size"`        // Messages remembered per room, 0 to remember none
+	HistoryReplay           int      `json:"history_replay"`      // Messages replayed on joining a room, also the HISTORY page size
+	LogDirectory            string   `json:"log_directory"`       // Where messages are logged, empty to not log them
+	LogSegmentSize          int64    `json:"log_segment_size"`    // Bytes written to a log segment before starting the next
+	LogRetentionSize        int64    `json:"log_retention_size"`  // Bytes of log kept, 0 for no limit
+	LogRetentionAge         Duration `json:"log_retention_age"`   // How long messages are kept in the log, 0 for no limit
+	FloodMessageRate        float64  `json:"flood_message_rate"`  // Lines per second a session may send, 0 for no limit
+	FloodMessageBurst       float64  `json:"flood_message_burst"` // Lines a session may send at once
+	FloodByteRate           float64  `json:"flood_byte_rate"`     // Bytes per second a session may send, 0 for no limit
+	FloodByteBurst          float64  `json:"flood_byte_burst"`    // Bytes a session may send at once
+	FloodRepeatLimit        int      `json:"flood_repeat_limit"`  // Identical lines in a row a session may send, 0 for no limit
+	FloodPenalty            string   `json:"flood_penalty"`       // What happens to a session that sends too much
+}
+
+// DefaultConfig returns the settings used when neither the config file nor
+// the command line says otherwise.
+func DefaultConfig() Config {
+	return Config{
+		ListenAddress:      ":8080",
+		ChannelBufferSize:  128,
+		SubnetPrefixIPv4:   24,
+		SubnetPrefixIPv6:   64,
+		MaxLineLength:      1024,
+		OutboundQueueSize:  128,
+		WriteTimeout:       Duration(10 * time.Second),
+		SlowConsumerPolicy: slowConsumerDisconnect,
+		DefaultRoom:        "lobby",
+		ShutdownNotice:     "* the server is shutting down, goodbye!",
+		ShutdownTimeout:    Duration(5 * time.Second),
+		BadWords:           WordList{"shit"},
+		BadWordWarning:     "That's a bad word!!",
+		FilterMode:         filterModeWarn,
+		HandshakeTimeout:   Duration(10 * time.Second),
+		AuthMaxFailures:    5,
+		AuthLockout:        Duration(5 * time.Minute),
+		LoginTimeout:       Duration(time.Minute),
+		HistorySize:        100,
+		HistoryReplay:      10,
+		LogSegmentSize:     4 << 20,
+		LogRetentionSize:   64 << 20,
+		LogRetentionAge:    Duration(7 * 24 * time.Hour),
+		FloodMessageRate:   5,
+		FloodMessageBurst:  10,
+		FloodByteRate:      4096,
+		FloodByteBurst:     16384,
+		FloodRepeatLimit:   3,
+		FloodPenalty:       floodPenaltyDelay,
+	}
+}
+
+// BindFlags registers a command-line flag for every setting in cfg, using the
+// current values as defaults.
+func (cfg *Config) BindFlags(flags *flag.FlagSet) {
+	flags.StringVar(&cfg.ListenAddress, "listen", cfg.ListenAddress, "address to listen on")
+	flags.IntVar(&cfg.ChannelBufferSize, "channel-buffer-size", cfg.ChannelBufferSize,
+		"capacity of the channels between the clients and the hub")
+	flags.IntVar(&cfg.MaxConnections, "max-connections", cfg.MaxConnections, "most clients connected at once, 0 for no limit")
+	flags.IntVar(&cfg.MaxConnectionsPerIP, "max-connections-per-ip", cfg.MaxConnectionsPerIP,
+		"most clients connected at once from one IP address, 0 for no limit")
+	flags.IntVar(&cfg.MaxConnectionsPerSubnet, "max-connections-per-subnet", cfg.MaxConnectionsPerSubnet,
+		"most clients connected at once from one subnet, 0 for no limit")
+	flags.IntVar(&cfg.SubnetPrefixIPv4, "subnet-prefix-ipv4", cfg.SubnetPrefixIPv4,
+		"length of the prefix that makes up an IPv4 subnet, for max-connections-per-subnet")
+	flags.IntVar(&cfg.SubnetPrefixIPv6, "subnet-prefix-ipv6", cfg.SubnetPrefixIPv6,
+		"length of the prefix that makes up an IPv6 subnet, for max-connections-per-subnet")
+	flags.IntVar(&cfg.MaxLineLength, "max-line-length", cfg.MaxLineLength, "longest accepted message line in bytes")
+	flags.IntVar(&cfg.OutboundQueueSize, "outbound-queue-size", cfg.OutboundQueueSize,
+		"messages that may be queued for delivery to one session")
+	flags.Var(&cfg.WriteTimeout, "write-timeout", "longest a write to a client may block, 0 for no limit")
+	flags.Var(&cfg.PingInterval, "ping-interval", "how long a client may be silent before it is sent a PING, 0 to never ping")
+	flags.Var(&cfg.IdleTimeout, "idle-timeout",
+		"how long a client may be silent before it is disconnected, answering a PING counts, 0 for no limit")
+	flags.StringVar(&cfg.SlowConsumerPolicy, "slow-consumer-policy", cfg.SlowConsumerPolicy,
+		"what to do when a client's outbound queue is full: drop-oldest, drop-newest or disconnect")
+	flags.StringVar(&cfg.DefaultRoom, "default-room", cfg.DefaultRoom, "room that new clients join, empty for none")
+	flags.StringVar(&cfg.ShutdownNotice, "shutdown-notice", cfg.ShutdownNotice,
+		"message sent to every client on shutdown, empty for none")
+	flags.Var(&cfg.ShutdownTimeout, "shutdown-timeout", "longest to wait for messages to be flushed to clients on shutdown")
+	flags.Var(&cfg.BadWords, "bad-words", "comma-separated words that the word filter looks for")
+	flags.StringVar(&cfg.BadWordsFile, "bad-words-file", cfg.BadWordsFile,
+		"file with more words for the word filter, one per line")
+	flags.StringVar(&cfg.BadWordWarning, "bad-word-warning", cfg.BadWordWarning, "warning sent for a bad word")
+	flags.StringVar(&cfg.FilterMode, "filter-mode", cfg.FilterMode,
+		"what to do about messages with bad words: warn the sender, mask the words or block the message")
+	flags.StringVar(&cfg.TLSCertFile, "tls-cert", cfg.TLSCertFile, "PEM certificate file, enables TLS")
+	flags.StringVar(&cfg.TLSKeyFile, "tls-key", cfg.TLSKeyFile, "PEM private key file for -tls-cert")
+	flags.StringVar(&cfg.TLSClientCAFile, "tls-client-ca", cfg.TLSClientCAFile,
+		"PEM file of CAs that client certificates must be signed by; the certificate CN becomes the nick")
+	flags.BoolVar(&cfg.TLSSelfSigned, "tls-self-signed", cfg.TLSSelfSigned,
+		"enable TLS with a generated self-signed certificate, for testing")
+	flags.Var(&cfg.HandshakeTimeout, "handshake-timeout", "longest a client may take to complete the TLS handshake")
+	flags.StringVar(&cfg.AuthFile, "auth-file", cfg.AuthFile,
+		"credentials file that clients must log in with, managed with the user subcommand; empty to not require login")
+	flags.IntVar(&cfg.AuthMaxFailures, "auth-max-failures", cfg.AuthMaxFailures,
+		"failed logins in a row before an account is locked, 0 to never lock")
+	flags.Var(&cfg.AuthLockout, "auth-lockout", "how long an account stays locked after too many failed logins")
+	flags.Var(&cfg.LoginTimeout, "login-timeout", "longest a client may take to log in")
+	flags.Var(&cfg.Operators, "operators", "comma-separated accounts that are operators as soon as they connect")
+	flags.StringVar(&cfg.OperatorPassword, "operator-password", cfg.OperatorPassword,
+		"password that makes a client an operator with /OPER, empty to disable /OPER")
+	flags.StringVar(&cfg.BanFile, "ban-file", cfg.BanFile, "JSON file to keep bans in, empty to forget bans on restart")
+	flags.StringVar(&cfg.MetricsAddress, "metrics-listen", cfg.MetricsAddress,
+		"address to serve Prometheus metrics on at /metrics, empty to not serve them")
+	flags.StringVar(&cfg.IRCListenAddress, "irc-listen", cfg.IRCListenAddress,
+		"address to accept IRC clients on, empty to not accept them")
+	flags.StringVar(&cfg.WebListenAddress, "web-listen", cfg.WebListenAddress,
+		"address to serve the web chat page and its WebSocket endpoint on, empty to not serve them")
+	flags.IntVar(&cfg.HistorySize, "history-size", cfg.HistorySize, "messages remembered per room, 0 to remember none")
+	flags.IntVar(&cfg.HistoryReplay, "history-replay", cfg.HistoryReplay,
+		"messages replayed to clients joining a room, and shown per page by /HISTORY")
+	flags.StringVar(&cfg.LogDirectory, "log-dir", cfg.LogDirectory,
+		"directory to log messages in, so history survives restarts; empty to not log them")
+	flags.Int64Var(&cfg.LogSegmentSize, "log-segment-size", cfg.LogSegmentSize, "bytes written to each log file")
+	flags.Int64Var(&cfg.LogRetentionSize, "log-retention-size", cfg.LogRetentionSize,
+		"bytes of logged messages to keep, 0 for no limit")
+	flags.Var(&cfg.LogRetentionAge, "log-retention-age", "how long to keep logged messages, 0 for no limit")
+	flags.Float64Var(&cfg.FloodMessageRate, "flood-message-rate", cfg.FloodMessageRate,
+		"lines per second a client may send, 0 for no limit")
+	flags.Float64Var(&cfg.FloodMessageBurst, "flood-message-burst", cfg.FloodMessageBurst, "lines a client may send at once")
+	flags.Float64Var(&cfg.FloodByteRate, "flood-byte-rate", cfg.FloodByteRate, "bytes per second a client may send, 0 for no limit")
+	flags.Float64Var(&cfg.FloodByteBurst, "flood-byte-burst", cfg.FloodByteBurst, "bytes a client may send at once")
+	flags.IntVar(&cfg.FloodRepeatLimit, "flood-repeat-limit", cfg.FloodRepeatLimit,
+		"identical lines in a row a client may send, 0 for no limit")
+	flags.StringVar(&cfg.FloodPenalty, "flood-penalty", cfg.FloodPenalty,
+		"what happens to a client that sends too much: delay, drop or disconnect; repeated lines are never delayed")
+}
+
+// Validate checks that the settings make sense, normalizing them where
+// needed.
+func (cfg *Config) Validate() error {
+	if cfg.ListenAddress == "" {
+		return errors.New("listen address must not be empty")
+	}
+	if cfg.ChannelBufferSize < 0 {
+		return errors.New("channel-buffer-size must not be negative")
+	}
+	if cfg.MaxConnections < 0 {
+		return errors.New("max-connections must not be negative")
+	}
+	if cfg.MaxConnectionsPerIP < 0 {
+		return errors.New("max-connections-per-ip must not be negative")
+	}
+	if cfg.MaxConnectionsPerSubnet < 0 {
+		return errors.New("max-connections-per-subnet must not be negative")
+	}
+	if cfg.SubnetPrefixIPv4 < 0 || cfg.SubnetPrefixIPv4 > 32 {
+		return errors.New("subnet-prefix-ipv4 must be between 0 and 32")
+	}
+	if cfg.SubnetPrefixIPv6 < 0 || cfg.SubnetPrefixIPv6 > 128 {
+		return errors.New("subnet-prefix-ipv6 must be between 0 and 128")
+	}
+	if cfg.MaxLineLength < 1 {
+		return errors.New("max-line-length must be at least 1")
+	}
+	if cfg.OutboundQueueSize < 1 {
+		return errors.New("outbound-queue-size must be at least 1")
+	}
+	if cfg.WriteTimeout < 0 {
+		return errors.New("write-timeout must not be negative")
+	}
+	if cfg.PingInterval < 0 {
+		return errors.New("ping-interval must not be negative")
+	}
+	if cfg.IdleTimeout < 0 {
+		return errors.New("idle-timeout must not be negative")
+	}
+	if cfg.PingInterval > 0 && cfg.IdleTimeout > 0 && cfg.PingInterval >= cfg.IdleTimeout {
+		return errors.New("ping-interval must be shorter than idle-timeout")
+	}
+	switch cfg.SlowConsumerPolicy {
+	case slowConsumerDropOldest, slowConsumerDropNewest, slowConsumerDisconnect:
+	default:
+		return fmt.Errorf("unknown slow-consumer-policy %q", cfg.SlowConsumerPolicy)
+	}
+	if cfg.DefaultRoom != "" {
+		room, ok := normalizeRoomName(cfg.DefaultRoom)
+		if !ok {
+			return fmt.Errorf("invalid default-room %q", cfg.DefaultRoom)
+		}
+		cfg.DefaultRoom = room
+	}
+	if cfg.ShutdownTimeout < 0 {
+		return errors.New("shutdown-timeout must not be negative")
+	}
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return errors.New("tls-cert and tls-key must be given together")
+	}
+	if cfg.TLSSelfSigned && cfg.TLSCertFile != "" {
+		return errors.New("tls-self-signed cannot be combined with tls-cert")
+	}
+	if cfg.TLSClientCAFile != "" && !cfg.tlsEnabled() {
+		return errors.New("tls-client-ca requires tls-cert or tls-self-signed")
+	}
+	if cfg.HandshakeTimeout <= 0 {
+		return errors.New("handshake-timeout must be positive")
+	}
+	if cfg.AuthMaxFailures < 0 {
+		return errors.New("auth-max-failures must not be negative")
+	}
+	if cfg.AuthLockout < 0 {
+		return errors.New("auth-lockout must not be negative")
+	}
+	if cfg.LoginTimeout <= 0 {
+		return errors.New("login-timeout must be positive")
+	}
+	if cfg.HistorySize < 0 {
+		return errors.New("history-size must not be negative")
+	}
+	if cfg.HistoryReplay < 1 {
+		return errors.New("history-replay must be at least 1")
+	}
+	if cfg.LogSegmentSize < 1 {
+		return errors.New("log-segment-size must be at least 1")
+	}
+	if cfg.LogRetentionSize < 0 {
+		return errors.New("log-retention-size must not be negative")
+	}
+	if cfg.LogRetentionAge < 0 {
+		return errors.New("log-retention-age must not be negative")
+	}
+	if cfg.FloodMessageRate < 0 || cfg.FloodByteRate < 0 {
+		return errors.New("flood rates must not be negative")
+	}
+	if cfg.FloodMessageRate > 0 && cfg.FloodMessageBurst < 1 {
+		return errors.New("flood-message-burst must be at least 1")
+	}
+	if cfg.FloodByteRate > 0 && cfg.FloodByteBurst < 1 {
+		return errors.New("flood-byte-burst must be at least 1")
+	}
+	if cfg.FloodRepeatLimit < 0 {
+		return errors.New("flood-repeat-limit must not be negative")
+	}
+	switch cfg.FloodPenalty {
+	case floodPenaltyDelay, floodPenaltyDrop, floodPenaltyDisconnect:
+	default:
+		return fmt.Errorf("unknown flood-penalty %q", cfg.FloodPenalty)
+	}
+	switch cfg.FilterMode {
+	case filterModeWarn, filterModeMask, filterModeBlock:
+	default:
+		return fmt.Errorf("unknown filter-mode %q", cfg.FilterMode)
+	}
+	return nil
+}
+
+// tlsEnabled reports whether clients have to connect using TLS.
+func (cfg *Config) tlsEnabled() bool {
+	return cfg.TLSCertFile != "" || cfg.TLSSelfSigned
+}
+
+// ReadFile overrides settings with those found in a JSON config file.
+func (cfg *Config) ReadFile(name string) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(cfg); err != nil {
+		return fmt.Errorf("reading %s: %w", name, err)
+	}
+	return nil
+}
+
+// Duration is a time.Duration that is written as "1m30s" rather than as a
+// number of nanoseconds, both in JSON and on the command line.
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d *Duration) Set(value string) error {
+	parsed, err := time.ParseDuration(value)
+	*d = Duration(parsed)
+	return err
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	return d.Set(string(text))
+}
+
+// WordList is a list of words, given as a comma-separated list on the command
+// line.
+type WordList []string
+
+func (w WordList) String() string {
+	return strings.Join(w, ",")
+}
+
+func (w *WordList) Set(value string) error {
+	*w = nil
+	for _, word := range strings.Split(value, ",") {
+		if word = strings.TrimSpace(word); word != "" {
+			*w = append(*w, word)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package hub
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// event is something the hub tells a session. What the client gets to see of
+// it is up to the session's protocol.
+type event struct {
+	kind   string
+	id     string // ID of the message that caused the event, if its client gave one
+	time   time.Time
+	room   string   // Room the event happened in, if any
+	topic  string   // Topic a message was published on, if any
+	sender string   // Nick of whoever caused the event, if anyone
+	target string   // Whoever else the event is about, such as a new nick
+	text   string   // Without a line terminator
+	code   int      // IRC numeric reply for an error, 0 if there is none
+	names  []string // Members of the room, for a session joining it or asking
+	notice bool     // For messages, sent as an IRC NOTICE, which nothing answers
+}
+
+// Event kinds.
+const (
+	eventWelcome  = "welcome"  // The session has been admitted as sender
+	eventNotice   = "notice"   // text from the server
+	eventError    = "error"    // Something the session asked for went wrong
+	eventClosing  = "closing"  // The session is about to be disconnected
+	eventMessage  = "message"  // sender said text in room
+	eventHistory  = "history"  // sender said text in room, a while ago
+	eventPrivate  = "private"  // sender said text to the recipient alone
+	eventSent     = "sent"     // The recipient said text to target alone
+	eventAck      = "ack"      // A message from the recipient was published
+	eventTopic    = "topic"    // sender published text on topic
+	eventJoin     = "join"     // sender joined room
+	eventPart     = "part"     // sender left room
+	eventNick     = "nick"     // sender is now known as target
+	eventNames    = "names"    // names are in room
+	eventRaw      = "raw"      // text is a line of the session's protocol
+	eventProtocol = "protocol" // The recipient speaks the protocol named by text from now on
+	eventPing     = "ping"     // The recipient should answer with a PONG carrying text
+)
+
+// protocol is the language a session speaks with its client.
+type protocol interface {
+	// greet runs before the client becomes a session. It logs the client in
+	// if the hub requires it, and finds out what the client wants to be
+	// called. The connection deadlines are set for it.
+	greet(h *Hub, admitted *newConnection) error
+	// parse turns a line from the client into what it asks of the hub. It
+	// runs on the session's reader goroutine.
+	parse(line []byte) []publishMessage
+	// format turns an event into what is sent to the client going by nick,
+	// or returns nil if the client is not told about it.
+	format(nick string, e event) []byte
+}
+
+// send formats an event for a session and queues it.
+func (h *Hub) send(recipient *session, e event) {
+	if e.time.IsZero() {
+		e.time = time.Now()
+	}
+	if e.id == "" {
+		e.id = h.requestID
+	}
+	if message := recipient.protocol.format(recipient.nick, e); message != nil {
+		h.deliver(recipient, message)
+	}
+}
+
+// fail tells a session that something it asked for went wrong. The code and
+// target are for IRC clients, which expect a numeric reply naming what was
+// wrong. Nothing is sent for a notice, which must not be answered.
+func (h *Hub) fail(recipient *session, code int, target string, text string) {
+	if h.notice {
+		return
+	}
+	h.send(recipient, event{kind: eventError, code: code, target: target, text: text})
+}
+
+// textProtocol is the plain text protocol: every line from the client is a
+// message, unless it is a command starting with "/".
+type textProtocol struct{}
+
+func (textProtocol) greet(h *Hub, admitted *newConnection) error {
+	// A verified client certificate is as good as a password
+	if h.auth == nil || admitted.nick != "" {
+		return nil
+	}
+	user, err := h.login(admitted.transport)
+	admitted.nick = user
+	return err
+}
+
+func (textProtocol) parse(line []byte) []publishMessage {
+	if isCommand(line) {
+		switch name, args := parseCommand(line); name {
+		case "PROTOCOL":
+			return switchProtocol(args)
+		case "PONG":
+			return []publishMessage{{message: line, keepalive: true}}
+		}
+	}
+	// A PING may be answered the way it was sent, without the "/" of a
+	// command, but only the hub knows whether the line is an answer
+	if fields := strings.Fields(string(line)); len(fields) == 2 && fields[0] == "PONG" {
+		return []publishMessage{{message: line, pong: fields[1]}}
+	}
+	return []publishMessage{{message: line}}
+}
+
+// switchProtocol handles "/PROTOCOL <text|json>", which a client uses to pick
+// the protocol it speaks from then on. Only the plain text and JSON protocols
+// can be switched between.
+func switchProtocol(args []string) []publishMessage {
+	if len(args) != 1 {
+		return []publishMessage{{reply: &event{kind: eventNotice, text: "Usage: /PROTOCOL <text|json>"}}}
+	}
+	var p protocol
+	name := strings.ToLower(args[0])
+	switch name {
+	case "text":
+		p = textProtocol{}
+	case "json":
+		p = jsonProtocol{}
+	default:
+		return []publishMessage{{reply: &event{kind: eventError, text: "unknown protocol " + args[0]}}}
+	}
+	return []publishMessage{{protocol: p, reply: &event{kind: eventProtocol, text: name}}}
+}
+
+func (textProtocol) format(nick string, e event) []byte {
+	var line string
+	switch e.kind {
+	case eventWelcome, eventNotice, eventRaw:
+		line = e.text
+	case eventError, eventClosing:
+		line = "Error: " + e.text
+	case eventMessage:
+		line = "<" + e.sender + "> " + e.text
+	case eventHistory:
+		line = e.time.Format("[15:04] ") + "<" + e.sender + "> " + e.text
+	case eventPrivate:
+		line = "*" + e.sender + "* " + e.text
+	case eventSent:
+		line = "-> *" + e.target + "* " + e.text
+	case eventAck:
+		line = "Thanks for publishing!"
+	case eventTopic:
+		line = "[" + e.topic + "] <" + e.sender + "> " + e.text
+	case eventJoin:
+		line = fmt.Sprintf("* %s joined %s", e.sender, e.room)
+	case eventPart:
+		line = fmt.Sprintf("* %s left %s", e.sender, e.room)
+	case eventNick:
+		line = fmt.Sprintf("* %s is now known as %s", e.sender, e.target)
+	case eventNames:
+		line = fmt.Sprintf("* in %s: %s", e.room, strings.Join(e.names, ", "))
+	case eventProtocol:
+		line = "* you are speaking " + e.text + " now"
+	case eventPing:
+		line = "PING " + e.text
+	default:
+		return nil
+	}
+	return []byte(line + "\n")
+}
@@ -0,0 +1,159 @@
+package hub
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Filter inspects messages before they are delivered, and may rewrite or
+// block them. Filters run on the hub's goroutine, so they must not block.
+type Filter interface {
+	Filter(sender SessionInfo, message []byte) Verdict
+}
+
+// Verdict is what a Filter decided about a message.
+type Verdict struct {
+	Hit     bool   // The filter found something objectionable
+	Message []byte // Replacement for the message, nil to leave it as it is
+	Block   bool   // Drop the message instead of delivering it
+	Notice  string // Sent to the sender, if not empty
+}
+
+// Bot is a participant that lives inside the hub rather than behind a
+// connection. It hears every message broadcast to a room, once the filters
+// have had their say, and may answer in the same room.
+type Bot interface {
+	// Name is the nick the bot speaks under. No session may use it.
+	Name() string
+	// Hear is called with a message broadcast to room, without its line
+	// terminator. Every line it returns is broadcast to the room as coming
+	// from the bot. It runs on the hub's goroutine, so it must not block.
+	Hear(room string, sender SessionInfo, text string) []string
+}
+
+// filter runs a message through the filter pipeline, passing on what each
+// filter makes of it to the next. It reports whether the message should be
+// delivered at all.
+func (h *Hub) filter(sender *session, message []byte) ([]byte, bool) {
+	for _, f := range h.filters {
+		verdict := f.Filter(sender.info(), message)
+		if verdict.Hit {
+			h.stats.filterHits.Add(1)
+		}
+		if verdict.Notice != "" && !h.notice {
+			h.reply(sender, verdict.Notice)
+		}
+		if verdict.Block {
+			return nil, false
+		}
+		if verdict.Message != nil {
+			message = verdict.Message
+		}
+	}
+	return message, true
+}
+
+// runBots lets the bots hear a message broadcast to a room, and broadcasts
+// their answers to the room.
+func (h *Hub) runBots(room string, sender *session, message []byte) {
+	text := strings.TrimSuffix(string(message), "\n")
+	for _, bot := range h.bots {
+		for _, answer := range bot.Hear(room, sender.info(), text) {
+			answer = strings.TrimRight(answer, "\r\n")
+			if strings.ContainsAny(answer, "\r\n") {
+				log.Printf("Bot %s tried to say more than one line at once", bot.Name())
+				continue
+			}
+			h.remember(room, -1, bot.Name(), []byte(answer+"\n"))
+			h.notifyRoom(room, event{kind: eventMessage, room: room, sender: bot.Name(), text: answer})
+		}
+	}
+}
+
+// isBotName reports whether a nick belongs to one of the bots.
+func (h *Hub) isBotName(nick string) bool {
+	for _, bot := range h.bots {
+		if strings.EqualFold(bot.Name(), nick) {
+			return true
+		}
+	}
+	return false
+}
+
+// Word filter modes.
+const (
+	filterModeWarn  = "warn"  // Deliver the message, but warn the sender
+	filterModeMask  = "mask"  // Replace bad words with asterisks
+	filterModeBlock = "block" // Do not deliver the message at all
+)
+
+// wordFilter looks for whole words from a list, ignoring case.
+type wordFilter struct {
+	pattern *regexp.Regexp
+	mode    string
+	warning string
+}
+
+// newWordFilter builds the word filter described by cfg. It returns nil if
+// there are no words to look for.
+func newWordFilter(cfg Config) (*wordFilter, error) {
+	words := append([]string(nil), cfg.BadWords...)
+	if cfg.BadWordsFile != "" {
+		fileWords, err := readWordFile(cfg.BadWordsFile)
+		if err != nil {
+			return nil, err
+		}
+		words = append(words, fileWords...)
+	}
+	if len(words) == 0 {
+		return nil, nil
+	}
+	quoted := make([]string, len(words))
+	for i, word := range words {
+		quoted[i] = regexp.QuoteMeta(word)
+	}
+	// Match the words on their own, not as parts of longer words
+	pattern, err := regexp.Compile(`(?i)\b(?:` + strings.Join(quoted, "|") + `)\b`)
+	if err != nil {
+		return nil, err
+	}
+	return &wordFilter{pattern: pattern, mode: cfg.FilterMode, warning: cfg.BadWordWarning}, nil
+}
+
+// readWordFile reads a list of words, one per line. Blank lines and lines
+// starting with "#" are skipped.
+func readWordFile(name string) ([]string, error) {
+	content, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var words []string
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			words = append(words, line)
+		}
+	}
+	return words, nil
+}
+
+func (f *wordFilter) Filter(sender SessionInfo, message []byte) Verdict {
+	if !f.pattern.Match(message) {
+		return Verdict{}
+	}
+	verdict := Verdict{Hit: true, Notice: f.warning}
+	switch f.mode {
+	case filterModeMask:
+		verdict.Message = f.pattern.ReplaceAllFunc(message, func(word []byte) []byte {
+			return bytes.Repeat([]byte("*"), utf8.RuneCount(word))
+		})
+	case filterModeBlock:
+		verdict.Block = true
+		verdict.Notice += " (your message was not delivered)"
+	}
+	return verdict
+}
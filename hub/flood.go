@@ -0,0 +1,106 @@
+package hub
+
+import (
+	"bytes"
+	"math"
+	"time"
+)
+
+// Flood penalties, for sessions sending lines faster than allowed.
+const (
+	floodPenaltyDelay      = "delay"      // Hold lines back until they are within the limits
+	floodPenaltyDrop       = "drop"       // Discard lines beyond the limits
+	floodPenaltyDisconnect = "disconnect" // Disconnect the session
+)
+
+// floodGuard keeps track of what a session is sending, to catch it sending
+// too much. It is only used by the session's reader goroutine.
+type floodGuard struct {
+	lines       *tokenBucket // nil when not limited
+	bytes       *tokenBucket // nil when not limited
+	repeatLimit int
+	lastLine    []byte
+	repeats     int // Times lastLine was sent in a row, beyond the first
+}
+
+func newFloodGuard(cfg Config) *floodGuard {
+	return &floodGuard{
+		lines:       newTokenBucket(cfg.FloodMessageRate, cfg.FloodMessageBurst),
+		bytes:       newTokenBucket(cfg.FloodByteRate, cfg.FloodByteBurst),
+		repeatLimit: cfg.FloodRepeatLimit,
+	}
+}
+
+// check looks at a line that is about to be sent. It returns how long to
+// wait before the line fits within the rate limits, and whether the line
+// repeats the previous ones too many times. Keepalives are meant to be
+// repeated, so they only count against the rate limits.
+func (g *floodGuard) check(line []byte, keepalive bool, now time.Time) (time.Duration, bool) {
+	repeated := false
+	if !keepalive {
+		if bytes.Equal(line, g.lastLine) {
+			g.repeats++
+		} else {
+			g.lastLine = line
+			g.repeats = 0
+		}
+		repeated = g.repeatLimit > 0 && g.repeats >= g.repeatLimit
+	}
+	wait := g.lines.delay(1, now)
+	if byteWait := g.bytes.delay(float64(len(line)), now); byteWait > wait {
+		wait = byteWait
+	}
+	return wait, repeated
+}
+
+// take counts a line that is being sent against the rate limits.
+func (g *floodGuard) take(line []byte, now time.Time) {
+	g.lines.take(1, now)
+	g.bytes.take(float64(len(line)), now)
+}
+
+// tokenBucket allows rate tokens per second on average, and up to burst at
+// once.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time // When tokens was last brought up to date
+}
+
+// newTokenBucket returns a full bucket, or nil if rate is 0. A nil bucket
+// never runs out.
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	if rate == 0 {
+		return nil
+	}
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// delay returns how long it will be until n tokens are available. Requests
+// for more than the burst size are treated as requests for the burst size.
+func (b *tokenBucket) delay(n float64, now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.refill(now)
+	n = math.Min(n, b.burst)
+	if b.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
+
+// take removes n tokens, or the burst size if that is less.
+func (b *tokenBucket) take(n float64, now time.Time) {
+	if b == nil {
+		return
+	}
+	b.refill(now)
+	b.tokens -= math.Min(n, b.burst)
+}
@@ -0,0 +1,35 @@
+package hub
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFloodGuardKeepalives(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.FloodMessageRate = 1
+	cfg.FloodMessageBurst = 3
+	cfg.FloodByteRate = 0
+	cfg.FloodRepeatLimit = 1
+	guard := newFloodGuard(cfg)
+	now := time.Now()
+	ping := []byte("PING x\r\n")
+	for i := range 3 {
+		wait, repeated := guard.check(ping, true, now)
+		if wait != 0 || repeated {
+			t.Fatalf("keepalive %d: check() = %v, %v, want it let through", i, wait, repeated)
+		}
+		guard.take(ping, now)
+	}
+	// Keepalives are never repeats, but they do use up the rate
+	if wait, repeated := guard.check(ping, true, now); wait != time.Second || repeated {
+		t.Errorf("keepalive beyond the burst: check() = %v, %v, want %v, false", wait, repeated, time.Second)
+	}
+	if wait, repeated := guard.check([]byte("hello\n"), false, now.Add(time.Second)); wait != 0 || repeated {
+		t.Errorf("line after the keepalives: check() = %v, %v, want it let through", wait, repeated)
+	}
+	guard.take([]byte("hello\n"), now.Add(time.Second))
+	if _, repeated := guard.check([]byte("hello\n"), false, now.Add(2*time.Second)); !repeated {
+		t.Error("repeated line after the keepalives was not caught")
+	}
+}
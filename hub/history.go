@@ -0,0 +1,301 @@
+package hub
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// replayHistory sends a page of a room's history to a session. It reports
+// whether there was anything on the page.
+func (h *Hub) replayHistory(recipient *session, room string, page int) bool {
+	entries, pages := h.history[room].page(page, h.cfg.HistoryReplay)
+	if len(entries) == 0 {
+		return false
+	}
+	h.reply(recipient, fmt.Sprintf("* history of %s, page %d of %d:", room, page, pages))
+	for _, entry := range entries {
+		h.send(recipient, event{kind: eventHistory, time: entry.time, room: room, sender: entry.sender, text: entry.text})
+	}
+	return true
+}
+
+// remember adds a message to a room's history, and to the message log. Bots
+// have no session, and are logged with a session ID of -1.
+func (h *Hub) remember(room string, sessionID int, nick string, message []byte) {
+	record := logRecord{
+		Time:    time.Now(),
+		Session: sessionID,
+		Sender:  nick,
+		Room:    room,
+		Message: strings.TrimSuffix(string(message), "\n"),
+	}
+	h.addToHistory(record)
+	if h.messageLog != nil {
+		if err := h.messageLog.append(record); err != nil {
+			log.Print("Failed to log message: ", err)
+		}
+	}
+}
+
+// addToHistory adds a logged message to its room's history.
+func (h *Hub) addToHistory(record logRecord) {
+	if h.cfg.HistorySize == 0 {
+		return
+	}
+	if h.history[record.Room] == nil {
+		h.history[record.Room] = newMessageHistory(h.cfg.HistorySize)
+	}
+	h.history[record.Room].add(historyEntry{time: record.Time, sender: record.Sender, text: record.Message})
+}
+
+// openMessageLog opens the message log and loads the history it holds.
+func (h *Hub) openMessageLog() error {
+	var err error
+	h.messageLog, err = openMessageLog(h.cfg)
+	if err != nil {
+		return err
+	}
+	loaded := 0
+	err = h.messageLog.replay(func(record logRecord) {
+		h.addToHistory(record)
+		loaded++
+	})
+	log.Printf("Loaded %d messages from %s", loaded, h.cfg.LogDirectory)
+	return err
+}
+
+// logRecord is a message as it is written to the message log.
+type logRecord struct {
+	Time    time.Time `json:"time"`
+	Session int       `json:"session"`
+	Sender  string    `json:"sender"`
+	Room    string    `json:"room"`
+	Message string    `json:"message"`
+}
+
+// messageLog is an append-only log of messages, kept as a directory of
+// segment files with one JSON record per line. Segments are numbered in the
+// order they were written, and old segments are deleted to stay within the
+// retention limits.
+type messageLog struct {
+	directory     string
+	segmentSize   int64
+	retentionSize int64
+	retentionAge  time.Duration
+	segments      []int    // Numbers of the segments on disk, oldest first
+	current       *os.File // The last segment, which is appended to
+	currentSize   int64
+}
+
+const logSegmentSuffix = ".log"
+
+// openMessageLog opens the message log in cfg.LogDirectory, creating the
+// directory if needed. Writing carries on in the last segment if it has room.
+func openMessageLog(cfg Config) (*messageLog, error) {
+	l := &messageLog{
+		directory:     cfg.LogDirectory,
+		segmentSize:   cfg.LogSegmentSize,
+		retentionSize: cfg.LogRetentionSize,
+		retentionAge:  time.Duration(cfg.LogRetentionAge),
+	}
+	if err := os.MkdirAll(l.directory, 0o755); err != nil {
+		return nil, err
+	}
+	dirEntries, err := os.ReadDir(l.directory)
+	if err != nil {
+		return nil, err
+	}
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		if !strings.HasSuffix(name, logSegmentSuffix) {
+			continue
+		}
+		if number, err := strconv.Atoi(strings.TrimSuffix(name, logSegmentSuffix)); err == nil {
+			l.segments = append(l.segments, number)
+		}
+	}
+	sort.Ints(l.segments)
+	if len(l.segments) > 0 {
+		last := l.segmentPath(l.segments[len(l.segments)-1])
+		if info, err := os.Stat(last); err == nil && info.Size() < l.segmentSize {
+			if l.current, err = os.OpenFile(last, os.O_WRONLY|os.O_APPEND, 0); err != nil {
+				return nil, err
+			}
+			l.currentSize = info.Size()
+			return l, l.enforceRetention()
+		}
+	}
+	if err := l.startSegment(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *messageLog) segmentPath(number int) string {
+	return filepath.Join(l.directory, fmt.Sprintf("%010d%s", number, logSegmentSuffix))
+}
+
+// startSegment closes the current segment, if any, and starts the next one.
+// Segments that have fallen outside the retention limits are deleted.
+func (l *messageLog) startSegment() error {
+	if l.current != nil {
+		if err := l.current.Close(); err != nil {
+			return err
+		}
+	}
+	number := 1
+	if len(l.segments) > 0 {
+		number = l.segments[len(l.segments)-1] + 1
+	}
+	file, err := os.OpenFile(l.segmentPath(number), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	l.segments = append(l.segments, number)
+	l.current = file
+	l.currentSize = 0
+	return l.enforceRetention()
+}
+
+// enforceRetention deletes the oldest segments while the log is larger than
+// the retention size or they hold nothing newer than the retention age. The
+// current segment is never deleted.
+func (l *messageLog) enforceRetention() error {
+	sizes := make([]int64, len(l.segments))
+	var totalSize int64
+	expired := 0 // Segments at the start of l.segments that are too old
+	for i, number := range l.segments {
+		info, err := os.Stat(l.segmentPath(number))
+		if err != nil {
+			return err
+		}
+		sizes[i] = info.Size()
+		totalSize += info.Size()
+		if l.retentionAge > 0 && time.Since(info.ModTime()) > l.retentionAge && expired == i {
+			expired++
+		}
+	}
+	deleted := 0
+	for deleted < len(l.segments)-1 {
+		tooBig := l.retentionSize > 0 && totalSize > l.retentionSize
+		if !tooBig && deleted >= expired {
+			break
+		}
+		if err := os.Remove(l.segmentPath(l.segments[deleted])); err != nil {
+			return err
+		}
+		totalSize -= sizes[deleted]
+		deleted++
+	}
+	l.segments = l.segments[deleted:]
+	return nil
+}
+
+// append writes a record to the log, moving on to a new segment when the
+// current one is full.
+func (l *messageLog) append(record logRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if l.currentSize > 0 && l.currentSize+int64(len(line))+1 > l.segmentSize {
+		if err := l.startSegment(); err != nil {
+			return err
+		}
+	}
+	written, err := l.current.Write(append(line, '\n'))
+	l.currentSize += int64(written)
+	return err
+}
+
+// replay calls fn for every record in the log that is within the retention
+// age, oldest first. Damaged lines, such as one cut short by a crash, are
+// skipped.
+func (l *messageLog) replay(fn func(logRecord)) error {
+	for _, number := range l.segments {
+		file, err := os.Open(l.segmentPath(number))
+		if err != nil {
+			return err
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			var record logRecord
+			if json.Unmarshal(scanner.Bytes(), &record) != nil {
+				continue
+			}
+			if l.retentionAge > 0 && time.Since(record.Time) > l.retentionAge {
+				continue
+			}
+			fn(record)
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *messageLog) close() error {
+	return l.current.Close()
+}
+
+// messageHistory is a ring buffer of the most recent messages of a room.
+type messageHistory struct {
+	entries []historyEntry
+	start   int // Index of the oldest entry once the buffer is full
+}
+
+// historyEntry is a message, who sent it and when.
+type historyEntry struct {
+	time   time.Time
+	sender string
+	text   string
+}
+
+func newMessageHistory(size int) *messageHistory {
+	return &messageHistory{entries: make([]historyEntry, 0, size)}
+}
+
+// add appends an entry, overwriting the oldest one if the buffer is full.
+func (m *messageHistory) add(entry historyEntry) {
+	if len(m.entries) < cap(m.entries) {
+		m.entries = append(m.entries, entry)
+		return
+	}
+	m.entries[m.start] = entry
+	m.start = (m.start + 1) % len(m.entries)
+}
+
+// page returns one page of entries, oldest first, along with the number of
+// pages. Page 1 holds the most recent entries. A nil history is empty.
+func (m *messageHistory) page(page int, pageSize int) ([]historyEntry, int) {
+	if m == nil || len(m.entries) == 0 {
+		return nil, 0
+	}
+	pages := (len(m.entries) + pageSize - 1) / pageSize
+	if page > pages {
+		return nil, pages
+	}
+	// Count back from the newest entry, then map onto the ring
+	end := len(m.entries) - (page-1)*pageSize
+	begin := end - pageSize
+	if begin < 0 {
+		begin = 0
+	}
+	entries := make([]historyEntry, 0, end-begin)
+	for i := begin; i < end; i++ {
+		entries = append(entries, m.entries[(m.start+i)%len(m.entries)])
+	}
+	return entries, pages
+}
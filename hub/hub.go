@@ -0,0 +1,709 @@
+// Package hub is a line-based chat server. Clients connect over TCP, or any
+// other Transport, and exchange lines of text in rooms. Everything the hub
+// knows about its sessions is owned by a single goroutine, which the rest of
+// the server talks to over channels. IRC clients can be let in on a listener
+// of their own, where rooms are channels, and browsers over WebSocket.
+// Programs can switch to JSON envelopes with "/PROTOCOL json".
+//
+// A Hub is created with New, extended with filters and bots, and run with
+// Start until Stop is called:
+//
+//	h, err := hub.New(hub.DefaultConfig())
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	h.AddBot(myBot)
+//	if err := h.Start(); err != nil {
+//		log.Fatal(err)
+//	}
+//	defer h.Stop()
+package hub
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type publishMessage struct {
+	message   []byte
+	sessionID int
+	room      string   // Room to publish in, empty for every room the session is in
+	reply     *event   // Sent back to the session instead of publishing message, if set
+	hangUp    bool     // For replies, disconnect the session once it has been sent
+	literal   bool     // Publish message even if it looks like a command
+	id        string   // Given by the client, and passed on with whatever the message causes
+	protocol  protocol // If set, the session speaks this protocol from now on
+	keepalive bool     // Only shows the client is alive, such as a PING or PONG
+	notice    bool     // Sent as an IRC NOTICE, so delivered as one and never answered
+	pong      string   // Token of the PING that message answers, unless it is just a message
+}
+
+// session is the hub's view of a single client connection. Everything sent to
+// the client goes through outbound, which is drained in order by the session's
+// writer goroutine.
+type session struct {
+	id            int
+	nick          string
+	account       string // Name the client has proven to own, empty for a guest
+	address       netip.Addr
+	operator      bool
+	mutedUntil    time.Time // Zero if the session may speak
+	transport     Transport
+	protocol      protocol
+	outbound      chan []byte
+	dropped       int             // Messages discarded because outbound was full
+	rooms         map[string]bool // Names of the rooms the session is a member of
+	subscriptions map[string]bool // Topic filters the session is subscribed to
+	removed       bool            // Set once outbound has been closed
+	lastHeard     atomic.Int64    // When the client last sent a line, in Unix nanoseconds, set by the reader
+	pingToken     string          // Token of the PING the client has yet to answer, if any
+	pingSent      time.Time       // When that PING was sent
+	timedOut      bool            // Set once the session has been told it was idle for too long
+}
+
+// SessionInfo describes a session to filters and bots.
+type SessionInfo struct {
+	ID       int
+	Nick     string
+	Account  string // Name the client has proven to own, empty for a guest
+	Address  netip.Addr
+	Operator bool
+}
+
+func (s *session) info() SessionInfo {
+	return SessionInfo{ID: s.id, Nick: s.nick, Account: s.account, Address: s.address, Operator: s.operator}
+}
+
+// Slow consumer policies, applied when a message is delivered to a session
+// whose outbound queue is full.
+const (
+	slowConsumerDropOldest = "drop-oldest" // Discard the oldest queued message
+	slowConsumerDropNewest = "drop-newest" // Discard the message being delivered
+	slowConsumerDisconnect = "disconnect"  // Disconnect the session
+)
+
+// hubStats counts what goes on in the hub, for the logs and for metrics. The
+// counters are updated from several goroutines.
+type hubStats struct {
+	messagesReceived        atomic.Int64
+	bytesReceived           atomic.Int64
+	messagesSent            atomic.Int64
+	bytesSent               atomic.Int64
+	writeLatency            *histogram
+	limitRejections         map[string]*atomic.Int64 // Clients turned away by each connection limit
+	droppedMessages         atomic.Int64
+	slowConsumerDisconnects atomic.Int64
+	writeTimeouts           atomic.Int64
+	filterHits              atomic.Int64
+	floodPenalties          atomic.Int64
+	pingsSent               atomic.Int64
+	pongsReceived           atomic.Int64
+	idleDisconnects         atomic.Int64
+	temporaryAcceptErrors   atomic.Int64
+	permanentAcceptErrors   atomic.Int64
+}
+
+// Hub owns the set of sessions. Fields that do not look after their own
+// synchronization are only used by the goroutine running the hub's main loop.
+type Hub struct {
+	cfg                Config
+	stats              hubStats
+	listener           net.Listener
+	ircListener        net.Listener // nil if IRC clients are not accepted
+	webServer          *http.Server // nil if the web page is not served
+	metricsServer      *http.Server // nil if metrics are not served
+	filters            []Filter     // Run in order on every broadcast
+	bots               []Bot
+	messageLog         *messageLog    // nil if messages are not logged
+	auth               *authenticator // nil if clients need not log in
+	bans               *banList
+	limits             *connectionLimits
+	writers            sync.WaitGroup // Running sessionWriter goroutines
+	connections        map[int]*session
+	rooms              map[string]map[int]*session // Members of each room, by session ID
+	nicks              map[string]*session         // Sessions by lower-cased nick
+	history            map[string]*messageHistory  // Recent messages of each room
+	topics             *topicNode                  // Root of the topic tree
+	requestID          string                      // ID of the message being handled, if its client gave one
+	notice             bool                        // The message being handled is a notice, which nothing answers
+	newConnections     chan newConnection
+	deadConnectionsIDs chan int
+	publishes          chan publishMessage
+	stop               chan struct{} // Requests a graceful shutdown
+	snapshots          chan chan hubSnapshot
+	done               chan struct{} // Closed once the main loop has returned
+}
+
+// newConnection is a connection that is ready to become a session.
+type newConnection struct {
+	transport  Transport
+	protocol   protocol
+	nick       string // Nick the client has proven to own, if any
+	wantedNick string // Nick the client asked for, if any
+}
+
+// New builds a hub from cfg, loading the word list, message log, and bans it
+// refers to. The hub does nothing until it is started.
+func New(cfg Config) (*Hub, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	h := &Hub{
+		cfg:                cfg,
+		connections:        make(map[int]*session),
+		rooms:              make(map[string]map[int]*session),
+		nicks:              make(map[string]*session),
+		history:            make(map[string]*messageHistory),
+		topics:             &topicNode{},
+		limits:             newConnectionLimits(cfg),
+		newConnections:     make(chan newConnection, cfg.ChannelBufferSize),
+		deadConnectionsIDs: make(chan int, cfg.ChannelBufferSize),
+		publishes:          make(chan publishMessage, cfg.ChannelBufferSize),
+		stop:               make(chan struct{}, 1),
+		snapshots:          make(chan chan hubSnapshot),
+		done:               make(chan struct{}),
+	}
+	h.stats.writeLatency = newHistogram(writeLatencyBuckets)
+	h.stats.limitRejections = make(map[string]*atomic.Int64)
+	for limit := range limitReasons {
+		h.stats.limitRejections[limit] = new(atomic.Int64)
+	}
+	wordFilter, err := newWordFilter(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if wordFilter != nil {
+		h.filters = append(h.filters, wordFilter)
+	}
+	if cfg.LogDirectory != "" {
+		if err := h.openMessageLog(); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.AuthFile != "" {
+		h.auth = newAuthenticator(cfg)
+	}
+	if h.bans, err = loadBanList(cfg.BanFile); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// AddFilter adds a filter to the end of the pipeline that messages go through
+// before they are delivered. It must be called before Start.
+func (h *Hub) AddFilter(f Filter) {
+	h.filters = append(h.filters, f)
+}
+
+// AddBot adds a bot that hears every message broadcast to a room. It must be
+// called before Start.
+func (h *Hub) AddBot(b Bot) {
+	h.bots = append(h.bots, b)
+}
+
+// Start listens on the configured addresses and runs the hub in the
+// background. Clients can connect as soon as Start returns.
+func (h *Hub) Start() error {
+	var tlsConfig *tls.Config
+	if h.cfg.tlsEnabled() {
+		var err error
+		if tlsConfig, err = newTLSConfig(h.cfg); err != nil {
+			return err
+		}
+	}
+	var err error
+	if h.listener, err = listen(h.cfg.ListenAddress, tlsConfig); err != nil {
+		return err
+	}
+	if h.cfg.IRCListenAddress != "" {
+		if h.ircListener, err = listen(h.cfg.IRCListenAddress, tlsConfig); err != nil {
+			h.closeListeners()
+			return err
+		}
+	}
+	if h.cfg.WebListenAddress != "" {
+		if h.webServer, err = serve(h.cfg.WebListenAddress, tlsConfig, h.WebHandler(), "Web"); err != nil {
+			h.closeListeners()
+			return err
+		}
+	}
+	if h.cfg.MetricsAddress != "" {
+		if h.metricsServer, err = serve(h.cfg.MetricsAddress, nil, h.MetricsHandler(), "Metrics"); err != nil {
+			h.closeListeners()
+			return err
+		}
+	}
+
+	// New incoming connection
+	go h.checkForNewIncomingConnections(h.listener, textProtocol{})
+	if h.ircListener != nil {
+		go h.checkForNewIncomingConnections(h.ircListener, ircProtocol{})
+	}
+	go func() {
+		h.run()
+		close(h.done)
+	}()
+	return nil
+}
+
+// listen listens for TCP connections on address, using TLS if tlsConfig is
+// not nil.
+func listen(address string, tlsConfig *tls.Config) (net.Listener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil || tlsConfig == nil {
+		return listener, err
+	}
+	return tls.NewListener(listener, tlsConfig), nil
+}
+
+// serve serves HTTP requests on address with handler, using TLS if tlsConfig
+// is not nil. The name of the server is for logging.
+func serve(address string, tlsConfig *tls.Config, handler http.Handler, name string) (*http.Server, error) {
+	listener, err := listen(address, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("%s server failed: %v", name, err)
+		}
+	}()
+	return server, nil
+}
+
+// closeListeners stops accepting clients, and stops serving HTTP.
+func (h *Hub) closeListeners() {
+	if h.listener != nil {
+		_ = h.listener.Close()
+	}
+	if h.ircListener != nil {
+		_ = h.ircListener.Close()
+	}
+	if h.webServer != nil {
+		// Sessions that came in over WebSocket are closed by the hub
+		_ = h.webServer.Close()
+	}
+	if h.metricsServer != nil {
+		_ = h.metricsServer.Close()
+	}
+}
+
+// Stop shuts the hub down gracefully, and returns once it is done. It may be
+// called more than once.
+func (h *Hub) Stop() {
+	h.requestStop()
+	<-h.done
+}
+
+// Done returns a channel that is closed once the hub has shut down, whether
+// because Stop was called or because it could no longer accept connections.
+func (h *Hub) Done() <-chan struct{} {
+	return h.done
+}
+
+// Addr returns the address the hub is listening on. It is only valid after
+// Start.
+func (h *Hub) Addr() net.Addr {
+	return h.listener.Addr()
+}
+
+// IRCAddr returns the address the hub is listening on for IRC clients, or
+// nil if it is not. It is only valid after Start.
+func (h *Hub) IRCAddr() net.Addr {
+	if h.ircListener == nil {
+		return nil
+	}
+	return h.ircListener.Addr()
+}
+
+// requestStop asks the hub's main loop to shut the server down. It is safe to
+// call from any goroutine, any number of times.
+func (h *Hub) requestStop() {
+	select {
+	case h.stop <- struct{}{}:
+	default:
+	}
+}
+
+// run is the hub's main loop.
+func (h *Hub) run() {
+	connectionCounter := 0 // Used to generate session IDs
+	var keepalive <-chan time.Time
+	if period := h.keepalivePeriod(); period > 0 {
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+		keepalive = ticker.C
+	}
+	for {
+		select {
+		case admitted := <-h.newConnections:
+			transport := admitted.transport
+			if admitted.nick != "" {
+				if ban := h.bans.matchAccount(admitted.nick); ban != nil {
+					log.Printf("Rejecting %v, account %s is banned", transport.RemoteAddr(), admitted.nick)
+					go rejectConnection(transport, admitted.protocol, "you are banned"+ban.describeReason())
+					continue
+				}
+			}
+			newSession := &session{
+				id:            connectionCounter,
+				transport:     transport,
+				protocol:      admitted.protocol,
+				account:       admitted.nick,
+				address:       remoteAddress(transport.RemoteAddr()),
+				outbound:      make(chan []byte, h.cfg.OutboundQueueSize),
+				rooms:         make(map[string]bool),
+				subscriptions: make(map[string]bool),
+			}
+			newSession.lastHeard.Store(time.Now().UnixNano())
+			h.connections[newSession.id] = newSession
+			h.writers.Add(1)
+			go h.sessionWriter(newSession)
+			go h.newConnectionSession(newSession)
+			connectionCounter++
+			log.Print("Number of connections: ", len(h.connections))
+			h.setNick(newSession, h.initialNick(newSession, admitted.nick, admitted.wantedNick))
+			for _, operator := range h.cfg.Operators {
+				if newSession.account == operator {
+					newSession.operator = true
+				}
+			}
+			welcome := event{kind: eventWelcome, sender: newSession.nick, text: "* you are known as " + newSession.nick}
+			if h.auth == nil {
+				welcome.text += ", use /NICK <name> to change it"
+			}
+			h.send(newSession, welcome)
+			if h.cfg.DefaultRoom != "" {
+				h.joinRoom(newSession, h.cfg.DefaultRoom)
+			}
+		case deadConnectionID := <-h.deadConnectionsIDs:
+			// Both the reader and the writer report a dead connection, so the
+			// session may already be gone
+			h.removeSession(deadConnectionID)
+		case publish := <-h.publishes:
+			// Replies share the channel with what the session publishes, so
+			// they stay in order with the replies to earlier lines
+			sender, ok := h.connections[publish.sessionID]
+			if !ok {
+				continue
+			}
+			h.requestID = publish.id
+			h.notice = publish.notice
+			if publish.protocol != nil {
+				sender.protocol = publish.protocol
+			}
+			switch {
+			case publish.reply != nil:
+				h.send(sender, *publish.reply)
+				if publish.hangUp {
+					h.removeSession(sender.id)
+				}
+			case publish.pong != "" && publish.pong == sender.pingToken:
+				h.pongCommand(sender, []string{publish.pong})
+			case publish.room != "":
+				h.broadcastTo(sender, publish.room, publish.message)
+			case isCommand(publish.message) && !publish.literal:
+				h.handleCommand(sender, publish.message)
+			default:
+				h.broadcast(sender, publish.message)
+			}
+			h.requestID = ""
+			h.notice = false
+		case now := <-keepalive:
+			h.checkIdleSessions(now)
+		case reply := <-h.snapshots:
+			reply <- h.snapshot()
+		case <-h.stop:
+			h.shutdown()
+			return
+		}
+	}
+}
+
+// shutdown stops accepting connections, says goodbye to every session and
+// waits for their outbound queues to be flushed. Connections that are still
+// being written to when the shutdown timeout expires are closed regardless.
+func (h *Hub) shutdown() {
+	h.closeListeners()
+	if h.messageLog != nil {
+		if err := h.messageLog.close(); err != nil {
+			log.Print("Failed to close the message log: ", err)
+		}
+	}
+	for _, s := range h.connections {
+		if h.cfg.ShutdownNotice != "" {
+			h.reply(s, h.cfg.ShutdownNotice)
+		}
+		// Skip removeSession, nobody is left to hear about who left
+		if !s.removed {
+			close(s.outbound)
+			s.removed = true
+		}
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		h.writers.Wait()
+		close(drained)
+	}()
+	timeout := time.After(time.Duration(h.cfg.ShutdownTimeout))
+	for {
+		select {
+		case <-drained:
+			return
+		case <-timeout:
+			log.Print("Timed out flushing outbound queues, closing remaining connections")
+			for _, s := range h.connections {
+				_ = s.transport.Close()
+			}
+			return
+		case admitted := <-h.newConnections:
+			_ = admitted.transport.Close()
+		// Keep session goroutines from blocking on the hub while draining
+		case <-h.deadConnectionsIDs:
+		case <-h.publishes:
+		}
+	}
+}
+
+// broadcast delivers a message to everyone sharing a room with the sender.
+func (h *Hub) broadcast(sender *session, message []byte) {
+	if len(sender.rooms) == 0 {
+		h.reply(sender, "Error: you are not in any room, use /JOIN <room> first")
+		return
+	}
+	rooms := make([]string, 0, len(sender.rooms))
+	for room := range sender.rooms {
+		rooms = append(rooms, room)
+	}
+	h.publish(sender, rooms, message)
+}
+
+// broadcastTo delivers a message to everyone in one of the sender's rooms.
+func (h *Hub) broadcastTo(sender *session, room string, message []byte) {
+	name, ok := normalizeRoomName(room)
+	if !ok {
+		h.fail(sender, 403, room, "invalid room name "+room)
+		return
+	}
+	if !sender.rooms[name] {
+		h.fail(sender, 442, room, "you are not in "+name)
+		return
+	}
+	h.publish(sender, []string{name}, message)
+}
+
+// publish runs a message through the filters and delivers it to the members
+// of the rooms given. Someone in several of the rooms only gets it once.
+func (h *Hub) publish(sender *session, rooms []string, message []byte) {
+	if h.isMuted(sender) {
+		return
+	}
+	message, ok := h.filter(sender, message)
+	if !ok {
+		return
+	}
+	text := strings.TrimSuffix(string(message), "\n")
+	delivered := map[int]bool{sender.id: true}
+	for _, room := range rooms {
+		h.remember(room, sender.id, sender.nick, message)
+		for id, recipient := range h.rooms[room] {
+			if !delivered[id] {
+				delivered[id] = true
+				h.send(recipient, event{kind: eventMessage, room: room, sender: sender.nick, text: text, notice: h.notice})
+			}
+		}
+	}
+	h.send(sender, event{kind: eventAck})
+	if h.notice {
+		// Bots must not answer a notice either
+		return
+	}
+	for _, room := range rooms {
+		h.runBots(room, sender, message)
+	}
+}
+
+// onlyKeepalives reports whether a line asked nothing of the hub but to keep
+// its connection alive.
+func onlyKeepalives(publishes []publishMessage) bool {
+	for _, publish := range publishes {
+		if !publish.keepalive {
+			return false
+		}
+	}
+	return len(publishes) > 0
+}
+
+// rejectConnection tells a client why it is not welcome and hangs up.
+func rejectConnection(transport Transport, p protocol, reason string) {
+	_ = transport.SetWriteDeadline(time.Now().Add(time.Second))
+	_ = transport.Write(p.format("*", event{kind: eventClosing, time: time.Now(), text: reason}))
+	_ = transport.Close()
+}
+
+// reply sends a line of text to a single session.
+func (h *Hub) reply(recipient *session, text string) {
+	h.send(recipient, event{kind: eventNotice, text: text})
+}
+
+// notifyRoom tells every member of a room about an event.
+func (h *Hub) notifyRoom(room string, e event) {
+	for _, member := range h.rooms[room] {
+		h.send(member, e)
+	}
+}
+
+// deliver queues message for recipient. If the queue is full, the configured
+// slow consumer policy decides what gives.
+func (h *Hub) deliver(recipient *session, message []byte) {
+	if recipient.removed {
+		return
+	}
+	select {
+	case recipient.outbound <- message:
+		return
+	default:
+	}
+
+	if h.cfg.SlowConsumerPolicy == slowConsumerDisconnect {
+		h.stats.slowConsumerDisconnects.Add(1)
+		log.Printf("Session %d outbound queue is full, disconnecting (%d slow consumers disconnected)",
+			recipient.id, h.stats.slowConsumerDisconnects.Load())
+		h.removeSession(recipient.id)
+		return
+	}
+	recipient.dropped++
+	h.stats.droppedMessages.Add(1)
+	if h.cfg.SlowConsumerPolicy == slowConsumerDropOldest {
+		// The hub is the only sender, so after taking one message there is
+		// room for another, unless the writer has emptied the queue first
+		select {
+		case <-recipient.outbound:
+		default:
+		}
+		recipient.outbound <- message
+	}
+}
+
+// removeSession forgets a session and closes its outbound queue. The session's
+// writer closes the connection once the queue has been drained.
+func (h *Hub) removeSession(id int) {
+	deadSession, ok := h.connections[id]
+	if !ok {
+		return
+	}
+	close(deadSession.outbound)
+	deadSession.removed = true
+	delete(h.connections, id)
+	delete(h.nicks, strings.ToLower(deadSession.nick))
+	for room := range deadSession.rooms {
+		h.partRoom(deadSession, room)
+	}
+	for filter := range deadSession.subscriptions {
+		h.unsubscribe(deadSession, filter)
+	}
+	if deadSession.dropped > 0 {
+		log.Printf("Session %d had %d messages dropped (%d dropped in total)",
+			id, deadSession.dropped, h.stats.droppedMessages.Load())
+	}
+	log.Print("Number of connections: ", len(h.connections))
+}
+
+// sessionWriter writes the messages queued for a session to its transport,
+// one at a time and in the order they were queued.
+func (h *Hub) sessionWriter(s *session) {
+	defer h.writers.Done()
+	defer s.transport.Close()
+	for message := range s.outbound {
+		started := time.Now()
+		if h.cfg.WriteTimeout > 0 {
+			_ = s.transport.SetWriteDeadline(started.Add(time.Duration(h.cfg.WriteTimeout)))
+		}
+		if err := s.transport.Write(message); err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				h.stats.writeTimeouts.Add(1)
+				log.Printf("Session %d write timed out (%d write timeouts in total)",
+					s.id, h.stats.writeTimeouts.Load())
+			}
+			h.deadConnectionsIDs <- s.id
+			return
+		}
+		h.stats.writeLatency.observe(time.Since(started))
+		h.stats.messagesSent.Add(1)
+		h.stats.bytesSent.Add(int64(len(message)))
+	}
+}
+
+func (h *Hub) newConnectionSession(s *session) {
+	maxLineLength := h.cfg.MaxLineLength
+	guard := newFloodGuard(h.cfg)
+	// s.protocol belongs to the hub, which switches it after this goroutine has
+	// sent the switch, so the reader keeps its own copy
+	p := s.protocol
+	warned := false // Only tell about the first of a run of dropped lines
+	// Wait for incoming lines
+	for {
+		line, err := s.transport.ReadLine()
+		if err == ErrLineTooLong {
+			tooLong := &event{kind: eventError, code: 417, text: fmt.Sprintf("line exceeds %d bytes and was discarded", maxLineLength)}
+			h.publishes <- publishMessage{reply: tooLong, sessionID: s.id}
+			continue
+		}
+		if err != nil {
+			// This includes the hub cutting short the read of an idle session
+			h.deadConnectionsIDs <- s.id
+			break
+		}
+		s.lastHeard.Store(time.Now().UnixNano())
+
+		publishes := p.parse(line)
+		wait, repeated := guard.check(line, onlyKeepalives(publishes), time.Now())
+		if wait > 0 || repeated {
+			h.stats.floodPenalties.Add(1)
+			penalty := h.cfg.FloodPenalty
+			if repeated && penalty == floodPenaltyDelay {
+				// Waiting does not make a repeated line any better
+				penalty = floodPenaltyDrop
+			}
+			switch penalty {
+			case floodPenaltyDelay:
+				time.Sleep(wait)
+			case floodPenaltyDrop:
+				if !warned {
+					dropping := &event{kind: eventError, text: "you are sending too much, your messages are being dropped"}
+					h.publishes <- publishMessage{reply: dropping, sessionID: s.id}
+					warned = true
+				}
+				continue
+			case floodPenaltyDisconnect:
+				log.Printf("Session %d is flooding, disconnecting", s.id)
+				goodbye := &event{kind: eventClosing, text: "you are sending too much, goodbye"}
+				h.publishes <- publishMessage{reply: goodbye, sessionID: s.id, hangUp: true}
+				return
+			}
+		}
+		guard.take(line, time.Now())
+		warned = false
+		h.stats.messagesReceived.Add(1)
+		h.stats.bytesReceived.Add(int64(len(line)))
+		for _, publish := range publishes {
+			publish.sessionID = s.id
+			if publish.protocol != nil {
+				p = publish.protocol
+			}
+			h.publishes <- publish
+		}
+	}
+}
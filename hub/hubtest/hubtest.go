@@ -0,0 +1,191 @@
+// Package hubtest runs a hub in-process for testing, and talks to it through
+// scripted fake clients. It also holds scenarios that check the behavior of
+// the hub end to end; Run runs all of them.
+package hubtest
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pdxiv/goteststuff/hub"
+)
+
+// DefaultTimeout is how long a client waits for a line before giving up.
+const DefaultTimeout = 5 * time.Second
+
+// Server is a hub listening on an ephemeral port of the loopback interface.
+type Server struct {
+	Hub     *hub.Hub
+	Addr    string // Where clients connect, set by Start
+	IRCAddr string // Where IRC clients connect, set by Start if the hub speaks IRC
+	cfg     hub.Config
+	t       testing.TB
+}
+
+// NewServer starts a hub built from cfg, and stops it when the test is over.
+// The listen address in cfg is ignored, and so is the IRC listen address,
+// except that IRC is only spoken if it is set.
+func NewServer(t testing.TB, cfg hub.Config) *Server {
+	s := NewUnstartedServer(t, cfg)
+	s.Start()
+	return s
+}
+
+// NewUnstartedServer builds a hub from cfg without starting it, so filters
+// and bots can be added to s.Hub first. The listen addresses in cfg are
+// treated as they are by NewServer.
+func NewUnstartedServer(t testing.TB, cfg hub.Config) *Server {
+	t.Helper()
+	cfg.ListenAddress = "127.0.0.1:0"
+	if cfg.IRCListenAddress != "" {
+		cfg.IRCListenAddress = "127.0.0.1:0"
+	}
+	h, err := hub.New(cfg)
+	if err != nil {
+		t.Fatal("creating hub: ", err)
+	}
+	return &Server{Hub: h, cfg: cfg, t: t}
+}
+
+// Start starts the hub, and arranges for it to be stopped when the test is
+// over.
+func (s *Server) Start() {
+	s.t.Helper()
+	if err := s.Hub.Start(); err != nil {
+		s.t.Fatal("starting hub: ", err)
+	}
+	s.Addr = s.Hub.Addr().String()
+	if addr := s.Hub.IRCAddr(); addr != nil {
+		s.IRCAddr = addr.String()
+	}
+	s.t.Cleanup(s.Hub.Stop)
+}
+
+// Dial connects a new client, and waits until it has been told its nick and
+// has joined the default room, if there is one.
+func (s *Server) Dial() *Client {
+	s.t.Helper()
+	c := s.DialRaw()
+	welcome := c.ReadLineOrFail()
+	fields := strings.Fields(welcome)
+	if !strings.HasPrefix(welcome, "* you are known as ") || len(fields) < 6 {
+		s.t.Fatalf("client got %q instead of a welcome", welcome)
+	}
+	c.Nick = strings.TrimSuffix(fields[5], ",")
+	if s.cfg.DefaultRoom != "" {
+		c.Expect(fmt.Sprintf("* %s joined %s", c.Nick, s.cfg.DefaultRoom))
+	}
+	return c
+}
+
+// DialRaw connects a new client without reading anything from the hub.
+func (s *Server) DialRaw() *Client {
+	s.t.Helper()
+	return s.dial(s.Addr)
+}
+
+// DialIRC connects a new IRC client, which has yet to register.
+func (s *Server) DialIRC() *Client {
+	s.t.Helper()
+	if s.IRCAddr == "" {
+		s.t.Fatal("the hub does not speak IRC")
+	}
+	return s.dial(s.IRCAddr)
+}
+
+func (s *Server) dial(addr string) *Client {
+	s.t.Helper()
+	connection, err := net.Dial("tcp", addr)
+	if err != nil {
+		s.t.Fatal("connecting to hub: ", err)
+	}
+	c := &Client{Timeout: DefaultTimeout, connection: connection, reader: bufio.NewReader(connection), t: s.t}
+	s.t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+// Client is a fake client that follows a script. Its methods that fail the
+// test on an error may only be called from the goroutine running the test;
+// other goroutines should stick to ReadLine and Write.
+type Client struct {
+	Nick       string        // Set by Server.Dial
+	Timeout    time.Duration // Longest to wait for a line
+	connection net.Conn
+	reader     *bufio.Reader
+	t          testing.TB
+}
+
+// ReadLine returns the next line from the hub, without its terminator, be it
+// "\n" or the "\r\n" of IRC.
+func (c *Client) ReadLine() (string, error) {
+	_ = c.connection.SetReadDeadline(time.Now().Add(c.Timeout))
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
+
+// Write sends lines to the hub, adding their terminators.
+func (c *Client) Write(lines ...string) error {
+	var text strings.Builder
+	for _, line := range lines {
+		text.WriteString(line + "\n")
+	}
+	_, err := c.connection.Write([]byte(text.String()))
+	return err
+}
+
+// ReadLineOrFail returns the next line from the hub, failing the test if
+// there is none.
+func (c *Client) ReadLineOrFail() string {
+	c.t.Helper()
+	line, err := c.ReadLine()
+	if err != nil {
+		c.t.Fatalf("%s: reading: %v", c.Nick, err)
+	}
+	return line
+}
+
+// Send sends lines to the hub, failing the test if they cannot be sent.
+func (c *Client) Send(lines ...string) {
+	c.t.Helper()
+	if err := c.Write(lines...); err != nil {
+		c.t.Fatalf("%s: sending: %v", c.Nick, err)
+	}
+}
+
+// Expect fails the test unless the next lines from the hub are the ones
+// given, in that order.
+func (c *Client) Expect(lines ...string) {
+	c.t.Helper()
+	for _, want := range lines {
+		if got := c.ReadLineOrFail(); got != want {
+			c.t.Fatalf("%s: got %q, want %q", c.Nick, got, want)
+		}
+	}
+}
+
+// ExpectClosed fails the test unless the hub hangs up after sending the
+// lines given.
+func (c *Client) ExpectClosed(lines ...string) {
+	c.t.Helper()
+	c.Expect(lines...)
+	line, err := c.ReadLine()
+	if err == nil {
+		c.t.Fatalf("%s: got %q, want the connection to be closed", c.Nick, line)
+	}
+	if netErr := net.Error(nil); errors.As(err, &netErr) && netErr.Timeout() {
+		c.t.Fatalf("%s: connection still open after %v", c.Nick, c.Timeout)
+	}
+}
+
+// Close hangs up.
+func (c *Client) Close() error {
+	return c.connection.Close()
+}
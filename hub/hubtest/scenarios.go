@@ -0,0 +1,480 @@
+package hubtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pdxiv/goteststuff/hub"
+)
+
+// Run runs every scenario in this package as a subtest of t.
+func Run(t *testing.T) {
+	scenarios := []struct {
+		name string
+		run  func(testing.TB)
+	}{
+		{"Delivery", Delivery},
+		{"Ordering", Ordering},
+		{"DisconnectCleanup", DisconnectCleanup},
+		{"Filters", Filters},
+		{"Stress", Stress},
+		{"IRC", IRC},
+		{"JSON", JSON},
+		{"Keepalive", Keepalive},
+		{"Limits", Limits},
+	}
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) { scenario.run(t) })
+	}
+}
+
+// Delivery checks that a message reaches everyone in the room but the
+// sender, who is thanked instead, and that private messages reach only their
+// recipient.
+func Delivery(t testing.TB) {
+	server := NewServer(t, hub.DefaultConfig())
+	alice, bob := server.Dial(), server.Dial()
+	alice.Expect("* " + bob.Nick + " joined lobby")
+	carol := server.Dial()
+	alice.Expect("* " + carol.Nick + " joined lobby")
+	bob.Expect("* " + carol.Nick + " joined lobby")
+
+	alice.Send("hello everyone")
+	alice.Expect("Thanks for publishing!")
+	bob.Expect("<" + alice.Nick + "> hello everyone")
+	carol.Expect("<" + alice.Nick + "> hello everyone")
+
+	bob.Send("/MSG " + carol.Nick + " just between us")
+	bob.Expect("-> *" + carol.Nick + "* just between us")
+	carol.Expect("*" + bob.Nick + "* just between us")
+
+	// Alice heard nothing of it, so the next thing she hears is this
+	carol.Send("bye")
+	alice.Expect("<" + carol.Nick + "> bye")
+}
+
+// Ordering checks that every client hears a sender's messages in the order
+// they were sent, even when a lot of them are sent at once.
+func Ordering(t testing.TB) {
+	const count = 200
+	cfg := hub.DefaultConfig()
+	cfg.FloodMessageRate = 0
+	cfg.FloodByteRate = 0
+	cfg.OutboundQueueSize = 2 * count
+	server := NewServer(t, cfg)
+	sender, listener := server.Dial(), server.Dial()
+	sender.Expect("* " + listener.Nick + " joined lobby")
+
+	lines := make([]string, count)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("message %d", i)
+	}
+	sender.Send(lines...)
+	for _, line := range lines {
+		listener.Expect("<" + sender.Nick + "> " + line)
+		sender.Expect("Thanks for publishing!")
+	}
+}
+
+// DisconnectCleanup checks that a client that hangs up leaves its rooms and
+// frees its nick, and that one that is told to go is really gone.
+func DisconnectCleanup(t testing.TB) {
+	cfg := hub.DefaultConfig()
+	cfg.FloodPenalty = "disconnect"
+	cfg.FloodRepeatLimit = 2
+	server := NewServer(t, cfg)
+	stayer, leaver := server.Dial(), server.Dial()
+	stayer.Expect("* " + leaver.Nick + " joined lobby")
+	leaver.Send("/NICK leaver")
+	leaver.Expect("* " + leaver.Nick + " is now known as leaver")
+	stayer.Expect("* " + leaver.Nick + " is now known as leaver")
+
+	_ = leaver.Close()
+	stayer.Expect("* leaver left lobby")
+	stayer.Send("/LIST")
+	stayer.Expect("lobby: 1 members")
+	stayer.Send("/NICK leaver")
+	stayer.Expect("* " + stayer.Nick + " is now known as leaver")
+	stayer.Nick = "leaver"
+
+	flooder := server.Dial()
+	stayer.Expect("* " + flooder.Nick + " joined lobby")
+	flooder.Send("again", "again", "again")
+	flooder.ExpectClosed("Thanks for publishing!", "Thanks for publishing!",
+		"Error: you are sending too much, goodbye")
+	stayer.Expect("<"+flooder.Nick+"> again", "<"+flooder.Nick+"> again", "* "+flooder.Nick+" left lobby")
+	stayer.Send("/LIST")
+	stayer.Expect("lobby: 1 members")
+}
+
+// Filters checks each word filter mode, and a filter added by the embedder.
+func Filters(t testing.TB) {
+	for _, mode := range []string{"warn", "mask", "block"} {
+		cfg := hub.DefaultConfig()
+		cfg.BadWords = hub.WordList{"darn"}
+		cfg.FilterMode = mode
+		server := NewUnstartedServer(t, cfg)
+		server.Hub.AddFilter(shouting{})
+		server.Start()
+		speaker, listener := server.Dial(), server.Dial()
+		speaker.Expect("* " + listener.Nick + " joined lobby")
+
+		speaker.Send("darn it", "DARNING is fine")
+		switch mode {
+		case "warn":
+			speaker.Expect("That's a bad word!!", "Thanks for publishing!")
+			listener.Expect("<" + speaker.Nick + "> darn it")
+		case "mask":
+			speaker.Expect("That's a bad word!!", "Thanks for publishing!")
+			listener.Expect("<" + speaker.Nick + "> **** it")
+		case "block":
+			speaker.Expect("That's a bad word!! (your message was not delivered)")
+		}
+		speaker.Expect("Error: please do not shout", "Thanks for publishing!")
+		listener.Expect("<" + speaker.Nick + "> darning is fine")
+	}
+}
+
+// shouting is a filter that turns capital letters down, and asks the sender
+// to stop shouting.
+type shouting struct{}
+
+func (shouting) Filter(sender hub.SessionInfo, message []byte) hub.Verdict {
+	text := string(message)
+	if strings.ToLower(text) == text {
+		return hub.Verdict{}
+	}
+	return hub.Verdict{Hit: true, Message: []byte(strings.ToLower(text)), Notice: "Error: please do not shout"}
+}
+
+// IRC checks that an IRC client can register, join a channel and talk with
+// plain text clients, that it gets numeric replies, and that it is never
+// answered for a NOTICE nor taken for a flooder for pinging.
+func IRC(t testing.TB) {
+	cfg := hub.DefaultConfig()
+	cfg.IRCListenAddress = "irc"
+	cfg.OperatorPassword = "secret"
+	cfg.BadWords = hub.WordList{"darn"}
+	cfg.FilterMode = "warn"
+	cfg.HistorySize = 0
+	cfg.FloodMessageRate = 0
+	cfg.FloodByteRate = 0
+	cfg.FloodRepeatLimit = 2
+	cfg.FloodPenalty = "disconnect"
+	server := NewServer(t, cfg)
+	alice := server.Dial()
+	alice.Send("/NICK alice")
+	alice.Expect("* " + alice.Nick + " is now known as alice")
+	alice.Nick = "alice"
+
+	bob := server.DialIRC()
+	bob.Nick = "bob"
+	bob.Send("CAP LS 302", "NICK bob", "USER bob 0 * :Bob")
+	bob.Expect(
+		":tcpserver CAP * LS :",
+		":tcpserver 001 bob :Welcome to the chat, bob",
+		":tcpserver 002 bob :Your host is tcpserver",
+		":tcpserver 003 bob :This server speaks a subset of IRC",
+		":tcpserver 004 bob tcpserver tcpserver o o",
+		":tcpserver 422 bob :MOTD File is missing",
+		":bob!bob@tcpserver JOIN #lobby",
+		":tcpserver 353 bob = #lobby :alice bob",
+		":tcpserver 366 bob #lobby :End of /NAMES list",
+	)
+	alice.Expect("* bob joined lobby")
+
+	bob.Send("PRIVMSG #lobby :hello alice", "PRIVMSG alice :psst")
+	alice.Expect("<bob> hello alice", "*bob* psst")
+	alice.Send("hello bob", "/MSG bob psst")
+	alice.Expect("Thanks for publishing!", "-> *bob* psst")
+	bob.Expect(":alice!alice@tcpserver PRIVMSG #lobby :hello bob", ":alice!alice@tcpserver PRIVMSG bob psst")
+	// No one gets to slip in a line of their own
+	alice.Send("hi\r:admin!admin@tcpserver PRIVMSG #lobby :trust me\x00")
+	alice.Expect("Thanks for publishing!")
+	bob.Expect(":alice!alice@tcpserver PRIVMSG #lobby :hi:admin!admin@tcpserver PRIVMSG #lobby :trust me")
+
+	// Nothing comes back for a NOTICE, not even an error
+	bob.Send("NOTICE nobody :hello?", "NOTICE #nowhere :hello?", "NOTICE alice :fyi")
+	alice.Expect("*bob* fyi")
+	// Clients ping as often as they like
+	bob.Send("PING one", "PING one", "PING one", "PING one")
+	for range 4 {
+		bob.Expect(":tcpserver PONG tcpserver one")
+	}
+	bob.Send("PRIVMSG nobody :hello?", "PRIVMSG #nowhere :hello?", "BOGUS")
+	bob.Expect(
+		":tcpserver 401 bob nobody :there is no one called nobody here",
+		":tcpserver 442 bob #nowhere :you are not in nowhere",
+		":tcpserver 421 bob BOGUS :Unknown command",
+	)
+
+	// A NOTICE arrives as one, and neither the filters nor a mute answer it
+	carol := server.DialIRC()
+	carol.Nick = "carol"
+	carol.Send("NICK carol", "USER carol 0 * :Carol")
+	// Skip the welcome, up to the end of the names in the lobby
+	for {
+		if strings.HasPrefix(carol.ReadLineOrFail(), ":tcpserver 366 ") {
+			break
+		}
+	}
+	alice.Expect("* carol joined lobby")
+	bob.Expect(":carol!carol@tcpserver JOIN #lobby")
+	carol.Send("NOTICE #lobby :darn bots", "NOTICE bob :fyi")
+	bob.Expect(":carol!carol@tcpserver NOTICE #lobby :darn bots", ":carol!carol@tcpserver NOTICE bob fyi")
+	alice.Expect("<carol> darn bots")
+	alice.Send("/OPER secret", "/MUTE carol")
+	alice.Expect("* you are now an operator", "* muted carol")
+	carol.Send("NOTICE #lobby :hello?", "PRIVMSG #lobby :hello?")
+	carol.Expect(":tcpserver NOTICE carol :* you have been muted by alice", ":tcpserver NOTICE carol :Error: you have been muted")
+
+	bob.Send("JOIN #dev")
+	bob.Expect(":bob!bob@tcpserver JOIN #dev", ":tcpserver 353 bob = #dev bob", ":tcpserver 366 bob #dev :End of /NAMES list")
+	bob.Send("PART #dev", "QUIT")
+	bob.ExpectClosed(":bob!bob@tcpserver PART #dev", "ERROR :Closing link")
+	alice.Expect("* bob left lobby")
+}
+
+// JSON checks that a client can switch to the JSON protocol and back, that
+// its envelopes are answered with envelopes carrying their id, and that it
+// hears from plain text clients in envelopes too.
+func JSON(t testing.TB) {
+	cfg := hub.DefaultConfig()
+	cfg.HistorySize = 0
+	server := NewServer(t, cfg)
+	alice, bob := server.Dial(), server.Dial()
+	alice.Expect("* " + bob.Nick + " joined lobby")
+	guest := bob.Nick
+
+	bob.Send("/PROTOCOL json")
+	expectEnvelope(bob, envelope{Type: "protocol", Sender: guest, Body: "json"})
+	bob.Send(`{"type":"command","id":"1","body":"NICK bob"}`)
+	expectEnvelope(bob, envelope{Type: "nick", ID: "1", Sender: guest, Body: "bob"})
+	alice.Expect("* " + guest + " is now known as bob")
+	bob.Nick = "bob"
+
+	bob.Send(`{"type":"message","id":"2","body":"hello"}`)
+	expectEnvelope(bob, envelope{Type: "ack", ID: "2"})
+	alice.Expect("<bob> hello")
+	// Messages are never taken for commands
+	bob.Send(`{"type":"message","id":"3","room":"lobby","body":"/QUIT"}`)
+	expectEnvelope(bob, envelope{Type: "ack", ID: "3"})
+	alice.Expect("<bob> /QUIT")
+	bob.Send(`{"type":"command","id":"4","body":"/MSG ` + alice.Nick + ` psst"}`)
+	expectEnvelope(bob, envelope{Type: "sent", ID: "4", Room: alice.Nick, Sender: "bob", Body: "psst"})
+	alice.Expect("*bob* psst")
+
+	alice.Send("hello bob")
+	alice.Expect("Thanks for publishing!")
+	expectEnvelope(bob, envelope{Type: "message", Room: "lobby", Sender: alice.Nick, Body: "hello bob"})
+
+	bob.Send(`{"type":"bogus","id":"5"}`, "not json", `{"type":"message","id":"6","body":"two\nlines"}`)
+	expectEnvelope(bob, envelope{Type: "error", ID: "5", Body: "unknown envelope type bogus"})
+	if line := bob.ReadLineOrFail(); !strings.Contains(line, `"body":"not a JSON envelope: `) {
+		t.Fatalf("bob: got %q, want an error about a line that is not an envelope", line)
+	}
+	expectEnvelope(bob, envelope{Type: "error", ID: "6", Body: "the body must be a single line"})
+
+	bob.Send(`{"type":"protocol","id":"7","body":"text"}`)
+	bob.Expect("* you are speaking text now")
+	bob.Send("back to text")
+	bob.Expect("Thanks for publishing!")
+	alice.Expect("<bob> back to text")
+}
+
+// envelope is a message of the hub's JSON protocol.
+type envelope struct {
+	Type      string `json:"type"`
+	ID        string `json:"id"`
+	Room      string `json:"room"`
+	Sender    string `json:"sender"`
+	Timestamp string `json:"timestamp"`
+	Body      string `json:"body"`
+}
+
+// expectEnvelope fails the test unless the next line a client hears is the
+// envelope given, with a timestamp of its own.
+func expectEnvelope(c *Client, want envelope) {
+	c.t.Helper()
+	line := c.ReadLineOrFail()
+	var got envelope
+	if err := json.Unmarshal([]byte(line), &got); err != nil {
+		c.t.Fatalf("%s: got %q, want an envelope: %v", c.Nick, line, err)
+	}
+	if _, err := time.Parse(time.RFC3339Nano, got.Timestamp); err != nil {
+		c.t.Fatalf("%s: got %q, want an envelope with a timestamp: %v", c.Nick, line, err)
+	}
+	got.Timestamp = ""
+	if got != want {
+		c.t.Fatalf("%s: got %+v, want %+v", c.Nick, got, want)
+	}
+}
+
+// Keepalive checks that a silent client is pinged and, if it never answers,
+// disconnected, while one that answers every PING stays connected.
+func Keepalive(t testing.TB) {
+	const pings = 4
+	cfg := hub.DefaultConfig()
+	cfg.PingInterval = hub.Duration(300 * time.Millisecond)
+	cfg.IdleTimeout = hub.Duration(time.Second)
+	server := NewServer(t, cfg)
+	alice, bob := server.Dial(), server.Dial()
+	alice.Expect("* " + bob.Nick + " joined lobby")
+
+	// Alice answers her PINGs while Bob sits there
+	answered := make(chan error, 1)
+	go func() {
+		left := false
+		for count := 0; count < pings || !left; {
+			line, err := alice.ReadLine()
+			if err != nil {
+				answered <- fmt.Errorf("%s: reading after %d PINGs: %w", alice.Nick, count, err)
+				return
+			}
+			switch token, ok := strings.CutPrefix(line, "PING "); {
+			case ok:
+				count++
+				if err := alice.Write("PONG " + token); err != nil {
+					answered <- fmt.Errorf("%s: sending: %w", alice.Nick, err)
+					return
+				}
+			case line == "* "+bob.Nick+" left lobby":
+				left = true
+			default:
+				answered <- fmt.Errorf("%s: unexpected line %q", alice.Nick, line)
+				return
+			}
+		}
+		answered <- nil
+	}()
+
+	if line := bob.ReadLineOrFail(); !strings.HasPrefix(line, "PING ") {
+		t.Fatalf("%s: got %q, want a PING", bob.Nick, line)
+	}
+	bob.ExpectClosed("Error: you have been idle for too long, goodbye")
+	if err := <-answered; err != nil {
+		t.Fatal(err)
+	}
+	// The PONGs were neither published nor taken for a flood, but what
+	// answers no PING is a message like any other
+	alice.Send("PONG ping")
+	alice.Expect("Thanks for publishing!")
+}
+
+// Limits checks that clients over the connection limits are told why and
+// hung up on, and that a client that leaves makes room for another.
+func Limits(t testing.TB) {
+	cfg := hub.DefaultConfig()
+	cfg.MaxConnectionsPerIP = 2
+	server := NewServer(t, cfg)
+	alice, bob := server.Dial(), server.Dial()
+	alice.Expect("* " + bob.Nick + " joined lobby")
+	server.DialRaw().ExpectClosed("Error: there are too many connections from your address, please try again later")
+
+	_ = bob.Close()
+	alice.Expect("* " + bob.Nick + " left lobby")
+	// The hub lets go of the connection a moment after the session is gone
+	deadline := time.Now().Add(DefaultTimeout)
+	for {
+		carol := server.DialRaw()
+		line := carol.ReadLineOrFail()
+		if strings.HasPrefix(line, "* you are known as ") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("still rejected after a client left: %q", line)
+		}
+		_ = carol.Close()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cfg = hub.DefaultConfig()
+	cfg.MaxConnections = 1
+	server = NewServer(t, cfg)
+	server.Dial()
+	server.DialRaw().ExpectClosed("Error: the server is full, please try again later")
+}
+
+// Stress has many clients talk at once, and checks that every client hears
+// every message from everyone else exactly once and in order. It is most
+// useful with the race detector on.
+func Stress(t testing.TB) {
+	clients, messages := 20, 50
+	if testing.Short() {
+		clients, messages = 5, 20
+	}
+	cfg := hub.DefaultConfig()
+	cfg.FloodMessageRate = 0
+	cfg.FloodByteRate = 0
+	cfg.FloodRepeatLimit = 0
+	cfg.OutboundQueueSize = clients*messages + clients
+	server := NewServer(t, cfg)
+	talkers := make([]*Client, clients)
+	for i := range talkers {
+		talkers[i] = server.Dial()
+	}
+
+	var wait sync.WaitGroup
+	errs := make(chan error, 2*clients)
+	for _, talker := range talkers {
+		wait.Add(2)
+		go func() {
+			defer wait.Done()
+			for i := 0; i < messages; i++ {
+				if err := talker.Write(fmt.Sprintf("%s %d", talker.Nick, i)); err != nil {
+					errs <- fmt.Errorf("%s: sending: %w", talker.Nick, err)
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wait.Done()
+			errs <- listen(talker, clients, messages)
+		}()
+	}
+	wait.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// listen reads what a client hears during the stress test until it has heard
+// everything it should, and checks that it came in order.
+func listen(c *Client, clients, messages int) error {
+	next := make(map[string]int) // Number of the next message from each nick
+	thanks := 0
+	for heard := 0; heard < (clients-1)*messages || thanks < messages; {
+		line, err := c.ReadLine()
+		if err != nil {
+			return fmt.Errorf("%s: reading after %d messages and %d thanks: %w", c.Nick, heard, thanks, err)
+		}
+		switch {
+		case line == "Thanks for publishing!":
+			thanks++
+		case strings.HasPrefix(line, "<"):
+			var nick, echo string
+			var number int
+			if _, err := fmt.Sscanf(line, "<%s %s %d", &nick, &echo, &number); err != nil {
+				return fmt.Errorf("%s: unexpected line %q", c.Nick, line)
+			}
+			nick = strings.TrimSuffix(nick, ">")
+			if nick == c.Nick || echo != nick || number != next[nick] {
+				return fmt.Errorf("%s: got %q, want message %d from %s", c.Nick, line, next[nick], nick)
+			}
+			next[nick]++
+			heard++
+		case strings.HasPrefix(line, "* "):
+			// Someone joining late
+		default:
+			return fmt.Errorf("%s: unexpected line %q", c.Nick, line)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,7 @@
+package hubtest
+
+import "testing"
+
+func TestScenarios(t *testing.T) {
+	Run(t)
+}
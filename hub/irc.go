@@ -0,0 +1,337 @@
+package hub
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Name the hub goes by towards IRC clients
+const ircServerName = "tcpserver"
+
+// Most names sent in one RPL_NAMREPLY, to keep lines short
+const ircNamesPerLine = 50
+
+// ircProtocol is the part of the IRC client protocol (RFC 1459 and RFC 2812)
+// that maps onto the hub: NICK, USER, PASS, JOIN, PART, PRIVMSG, NOTICE,
+// NAMES, PING, PONG and QUIT. Channels are rooms, with a "#" in front. The
+// hub's own SUB, UNSUB and PUB are understood too, and publications arrive as
+// notices.
+type ircProtocol struct{}
+
+// greet registers a client: it waits for NICK and USER, answering CAP and
+// PING in the meantime. If the hub requires login, the nick and the password
+// given with PASS are the username and password.
+func (p ircProtocol) greet(h *Hub, admitted *newConnection) error {
+	transport := admitted.transport
+	var nick, user, password string
+	for nick == "" || user == "" {
+		line, err := transport.ReadLine()
+		if err == ErrLineTooLong {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		var answer []string
+		command, params := parseIRCMessage(string(line))
+		switch command {
+		case "":
+		case "CAP":
+			answer = p.capability(params)
+		case "PASS":
+			if len(params) > 0 {
+				password = params[0]
+			}
+		case "NICK":
+			if len(params) == 0 {
+				answer = []string{ircNumeric(431, "*", "No nickname given")}
+			} else {
+				nick = params[0]
+			}
+		case "USER":
+			if len(params) < 4 {
+				answer = []string{ircNumeric(461, "*", "USER", "Not enough parameters")}
+			} else {
+				user = params[0]
+			}
+		case "PING":
+			answer = []string{ircPong(params)}
+		case "QUIT":
+			return errors.New("quit before registering")
+		default:
+			answer = []string{ircNumeric(451, "*", "You have not registered")}
+		}
+		if answer != nil {
+			if err := transport.Write(ircLines(answer)); err != nil {
+				return err
+			}
+		}
+	}
+	switch {
+	case admitted.nick != "":
+		// A verified client certificate is as good as a password
+	case h.auth != nil:
+		if err := h.auth.authenticate(nick, password); err != nil {
+			_ = transport.Write(ircLines([]string{ircNumeric(464, nick, err.Error())}))
+			return err
+		}
+		admitted.nick = nick
+	default:
+		admitted.wantedNick = nick
+	}
+	return nil
+}
+
+// capability answers a CAP command. The hub supports no capabilities, but
+// clients that ask wait for an answer before they register.
+func (ircProtocol) capability(params []string) []string {
+	if len(params) == 0 {
+		return nil
+	}
+	switch strings.ToUpper(params[0]) {
+	case "LS", "LIST":
+		return []string{ircLine(":"+ircServerName, "CAP", "*", strings.ToUpper(params[0]), "")}
+	case "REQ":
+		return []string{ircLine(":"+ircServerName, "CAP", "*", "NAK", strings.Join(params[1:], " "))}
+	}
+	return nil
+}
+
+func (p ircProtocol) parse(line []byte) []publishMessage {
+	command, params := parseIRCMessage(string(line))
+	switch command {
+	case "":
+		return nil
+	case "PRIVMSG", "NOTICE":
+		if len(params) < 2 || params[1] == "" {
+			if command == "NOTICE" {
+				// Nothing is ever sent back for a NOTICE
+				return nil
+			}
+			if len(params) == 0 {
+				return ircError(411, "", "No recipient given (PRIVMSG)")
+			}
+			return ircError(412, "", "No text to send")
+		}
+		var publishes []publishMessage
+		for _, target := range strings.Split(params[0], ",") {
+			publish := publishMessage{room: target, message: []byte(params[1] + "\n")}
+			if !strings.HasPrefix(target, "#") {
+				publish = hubCommand("MSG", target, params[1])
+			}
+			// Not even errors are sent back for a NOTICE
+			publish.notice = command == "NOTICE"
+			publishes = append(publishes, publish)
+		}
+		return publishes
+	case "JOIN", "PART", "NAMES":
+		if len(params) == 0 {
+			if command == "NAMES" {
+				return []publishMessage{hubCommand("NAMES")}
+			}
+			return ircError(461, command, "Not enough parameters")
+		}
+		var publishes []publishMessage
+		for _, room := range strings.Split(params[0], ",") {
+			publishes = append(publishes, hubCommand(command, room))
+		}
+		return publishes
+	case "SUB", "UNSUB":
+		return []publishMessage{hubCommand(command, params...)}
+	case "PUB":
+		if len(params) < 2 {
+			return ircError(461, command, "Not enough parameters")
+		}
+		return []publishMessage{hubCommand(command, params[0], params[1])}
+	case "NICK":
+		if len(params) == 0 {
+			return ircError(431, "", "No nickname given")
+		}
+		return []publishMessage{hubCommand("NICK", params[0])}
+	case "PING":
+		return []publishMessage{{reply: &event{kind: eventRaw, text: ircPong(params)}, keepalive: true}}
+	case "PONG":
+		if len(params) == 0 {
+			return nil
+		}
+		pong := hubCommand("PONG", params[len(params)-1])
+		pong.keepalive = true
+		return []publishMessage{pong}
+	case "QUIT":
+		return []publishMessage{{reply: &event{kind: eventClosing, text: "Closing link"}, hangUp: true}}
+	case "USER", "PASS":
+		return ircError(462, "", "You may not reregister")
+	case "CAP":
+		answer := p.capability(params)
+		if answer == nil {
+			return nil
+		}
+		return []publishMessage{{reply: &event{kind: eventRaw, text: answer[0]}}}
+	}
+	return ircError(421, command, "Unknown command")
+}
+
+// hubCommand builds the hub command that does what an IRC command asks.
+func hubCommand(name string, args ...string) publishMessage {
+	return publishMessage{message: []byte("/" + strings.Join(append([]string{name}, args...), " ") + "\n")}
+}
+
+// ircError builds a numeric error reply about target, which may be empty.
+func ircError(code int, target string, text string) []publishMessage {
+	return []publishMessage{{reply: &event{kind: eventError, code: code, target: target, text: text}}}
+}
+
+func (ircProtocol) format(nick string, e event) []byte {
+	if nick == "" {
+		nick = "*"
+	}
+	server := ":" + ircServerName
+	var lines []string
+	switch e.kind {
+	case eventWelcome:
+		lines = []string{
+			ircNumeric(1, e.sender, "Welcome to the chat, "+e.sender),
+			ircNumeric(2, e.sender, "Your host is "+ircServerName),
+			ircNumeric(3, e.sender, "This server speaks a subset of IRC"),
+			ircNumeric(4, e.sender, ircServerName, ircServerName, "o", "o"),
+			ircNumeric(422, e.sender, "MOTD File is missing"),
+		}
+	case eventNotice:
+		lines = []string{ircLine(server, "NOTICE", nick, e.text)}
+	case eventError:
+		if e.code == 0 {
+			lines = []string{ircLine(server, "NOTICE", nick, "Error: "+e.text)}
+		} else if e.target == "" {
+			lines = []string{ircNumeric(e.code, nick, e.text)}
+		} else {
+			lines = []string{ircNumeric(e.code, nick, e.target, e.text)}
+		}
+	case eventClosing:
+		lines = []string{ircLine("", "ERROR", e.text)}
+	case eventMessage:
+		lines = []string{ircLine(ircSource(e.sender), ircMessageCommand(e), "#"+e.room, e.text)}
+	case eventHistory:
+		lines = []string{ircLine(server, "NOTICE", "#"+e.room, e.time.Format("[15:04] ")+"<"+e.sender+"> "+e.text)}
+	case eventPrivate:
+		lines = []string{ircLine(ircSource(e.sender), ircMessageCommand(e), nick, e.text)}
+	case eventTopic:
+		lines = []string{ircLine(ircSource(e.sender), "NOTICE", nick, "["+e.topic+"] "+e.text)}
+	case eventJoin:
+		lines = []string{ircLine(ircSource(e.sender), "JOIN", "#"+e.room)}
+		if e.names != nil {
+			lines = append(lines, ircNames(nick, e.room, e.names)...)
+		}
+	case eventPart:
+		lines = []string{ircLine(ircSource(e.sender), "PART", "#"+e.room)}
+	case eventNick:
+		lines = []string{ircLine(ircSource(e.sender), "NICK", e.target)}
+	case eventNames:
+		lines = ircNames(nick, e.room, e.names)
+	case eventPing:
+		lines = []string{ircLine("", "PING", e.text)}
+	case eventRaw:
+		lines = []string{e.text}
+	default:
+		// IRC clients do not expect to hear about their own messages
+		return nil
+	}
+	return ircLines(lines)
+}
+
+// ircNames lists the members of a room with RPL_NAMREPLY and
+// RPL_ENDOFNAMES.
+func ircNames(nick string, room string, names []string) []string {
+	var lines []string
+	for len(names) > 0 {
+		count := min(len(names), ircNamesPerLine)
+		lines = append(lines, ircNumeric(353, nick, "=", "#"+room, strings.Join(names[:count], " ")))
+		names = names[count:]
+	}
+	return append(lines, ircNumeric(366, nick, "#"+room, "End of /NAMES list"))
+}
+
+// ircMessageCommand is the command a message is delivered with, NOTICE if it
+// was sent as one.
+func ircMessageCommand(e event) string {
+	if e.notice {
+		return "NOTICE"
+	}
+	return "PRIVMSG"
+}
+
+// ircPong answers a PING.
+func ircPong(params []string) string {
+	token := ircServerName
+	if len(params) > 0 {
+		token = params[0]
+	}
+	return ircLine(":"+ircServerName, "PONG", ircServerName, token)
+}
+
+// ircSource is how a session is named as the source of a message.
+func ircSource(nick string) string {
+	return ":" + nick + "!" + nick + "@" + ircServerName
+}
+
+// ircNumeric formats a numeric reply to nick.
+func ircNumeric(code int, nick string, params ...string) string {
+	return ircLine(":"+ircServerName, fmt.Sprintf("%03d", code), append([]string{nick}, params...)...)
+}
+
+// ircLine formats an IRC message. The last parameter is sent as a trailing
+// parameter if it has to be, because it is empty, holds spaces or starts
+// with a ":". Parameters lose any CR, LF and NUL, which a client could use to
+// pass off the rest of a message as a line of its own.
+func ircLine(prefix string, command string, params ...string) string {
+	line := command
+	if prefix != "" {
+		line = prefix + " " + command
+	}
+	for i, param := range params {
+		param = strings.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' || r == 0 {
+				return -1
+			}
+			return r
+		}, param)
+		if i == len(params)-1 && (param == "" || strings.ContainsRune(param, ' ') || strings.HasPrefix(param, ":")) {
+			param = ":" + param
+		}
+		line += " " + param
+	}
+	return line
+}
+
+// ircLines terminates lines the way IRC wants, and joins them together.
+func ircLines(lines []string) []byte {
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// parseIRCMessage splits an IRC message into its upper-cased command and its
+// parameters, dropping the prefix if there is one.
+func parseIRCMessage(line string) (string, []string) {
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, ":") {
+		if space := strings.IndexByte(line, ' '); space >= 0 {
+			line = line[space+1:]
+		} else {
+			line = ""
+		}
+	}
+	var trailing *string
+	if colon := strings.Index(line, " :"); colon >= 0 {
+		rest := line[colon+2:]
+		trailing = &rest
+		line = line[:colon]
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", nil
+	}
+	params := fields[1:]
+	if trailing != nil {
+		params = append(params, *trailing)
+	}
+	return strings.ToUpper(fields[0]), params
+}
@@ -0,0 +1,106 @@
+package hub
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// envelope is a message of the JSON protocol, sent as a single line.
+//
+// Clients send envelopes of type "message", with the text to publish as body
+// and optionally the room to publish it in, "command", with a command line as
+// body, "protocol", with the protocol to switch to as body, or "pong", with
+// the body of the "ping" it answers. The id is up to the client.
+//
+// The hub sends an envelope for each event, of the type of the event. The id
+// is that of the envelope that caused the event, if its client gave one. For
+// publications on a topic the room is the topic, and for private messages the
+// client has sent it is the recipient.
+type envelope struct {
+	Type      string `json:"type"`
+	ID        string `json:"id"`
+	Room      string `json:"room"`
+	Sender    string `json:"sender"`
+	Timestamp string `json:"timestamp"` // RFC 3339, in UTC
+	Body      string `json:"body"`
+}
+
+// jsonProtocol speaks in envelopes, one per line. Clients switch to it from
+// the plain text protocol with "/PROTOCOL json", and log in using the plain
+// text protocol before that if they have to.
+type jsonProtocol struct {
+	textProtocol
+}
+
+func (jsonProtocol) parse(line []byte) []publishMessage {
+	if len(bytes.TrimSpace(line)) == 0 {
+		return nil
+	}
+	var request envelope
+	if err := json.Unmarshal(line, &request); err != nil {
+		return []publishMessage{{reply: &event{kind: eventError, text: "not a JSON envelope: " + err.Error()}}}
+	}
+	fail := func(text string) []publishMessage {
+		return []publishMessage{{id: request.ID, reply: &event{kind: eventError, text: text}}}
+	}
+	if strings.ContainsAny(request.Body, "\r\n") {
+		return fail("the body must be a single line")
+	}
+	switch request.Type {
+	case "message":
+		if request.Body == "" {
+			return fail("the body must not be empty")
+		}
+		return []publishMessage{{id: request.ID, room: request.Room, literal: true, message: []byte(request.Body + "\n")}}
+	case "command":
+		command := "/" + strings.TrimPrefix(request.Body, "/")
+		if name, args := parseCommand([]byte(command)); name == "PROTOCOL" {
+			publishes := switchProtocol(args)
+			publishes[0].id = request.ID
+			return publishes
+		}
+		return []publishMessage{{id: request.ID, message: []byte(command + "\n")}}
+	case "protocol":
+		publishes := switchProtocol([]string{request.Body})
+		publishes[0].id = request.ID
+		return publishes
+	case "pong":
+		return []publishMessage{{id: request.ID, message: []byte("/PONG " + request.Body + "\n"), keepalive: true}}
+	}
+	return fail("unknown envelope type " + request.Type)
+}
+
+func (jsonProtocol) format(nick string, e event) []byte {
+	response := envelope{
+		Type:      e.kind,
+		ID:        e.id,
+		Room:      e.room,
+		Sender:    e.sender,
+		Timestamp: e.time.UTC().Format(time.RFC3339Nano),
+		Body:      e.text,
+	}
+	switch e.kind {
+	case eventTopic:
+		response.Room = e.topic
+	case eventSent:
+		response.Room = e.target
+	case eventNick:
+		response.Body = e.target
+	case eventNames:
+		response.Body = strings.Join(e.names, " ")
+	case eventProtocol:
+		// Tell a client that has just switched who it is
+		response.Sender = nick
+	case eventRaw:
+		return nil
+	}
+	var line bytes.Buffer
+	encoder := json.NewEncoder(&line)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(response); err != nil {
+		return nil
+	}
+	return line.Bytes()
+}
@@ -0,0 +1,62 @@
+package hub
+
+import (
+	"log"
+	"strconv"
+	"time"
+)
+
+// keepalivePeriod returns how often the hub looks for silent sessions, or 0
+// if it never has to.
+func (h *Hub) keepalivePeriod() time.Duration {
+	period := time.Duration(h.cfg.PingInterval)
+	if idle := time.Duration(h.cfg.IdleTimeout); idle > 0 && (period == 0 || idle < period) {
+		period = idle
+	}
+	// Check often enough for nobody to get much more time than they should
+	return period / 4
+}
+
+// checkIdleSessions pings the sessions that have been silent for the ping
+// interval, and disconnects those that have been silent for the idle timeout.
+// A session that has timed out is told so, then its reader is woken up by an
+// expired deadline, and it goes the way of any connection that failed.
+func (h *Hub) checkIdleSessions(now time.Time) {
+	for _, s := range h.connections {
+		if s.timedOut {
+			continue
+		}
+		silent := now.Sub(time.Unix(0, s.lastHeard.Load()))
+		if idleTimeout := time.Duration(h.cfg.IdleTimeout); idleTimeout > 0 && silent >= idleTimeout {
+			log.Printf("Session %d has been silent for %v, disconnecting", s.id, silent.Round(time.Second))
+			h.stats.idleDisconnects.Add(1)
+			h.send(s, event{kind: eventClosing, text: "you have been idle for too long, goodbye"})
+			s.timedOut = true
+			if err := s.transport.SetReadDeadline(now); err != nil {
+				// The reader cannot be woken up, so do without it
+				h.removeSession(s.id)
+			}
+			continue
+		}
+		// Ping again only if the client has spoken since the last PING
+		answered := s.pingToken == "" || s.pingSent.UnixNano() < s.lastHeard.Load()
+		if pingInterval := time.Duration(h.cfg.PingInterval); pingInterval > 0 && silent >= pingInterval && answered {
+			s.pingToken = strconv.FormatInt(h.stats.pingsSent.Add(1), 10)
+			s.pingSent = now
+			h.send(s, event{kind: eventPing, text: s.pingToken})
+		}
+	}
+}
+
+// pongCommand handles "/PONG <token>", the answer to a PING. Plain text
+// clients may also answer with "PONG <token>", which is a message unless the
+// token is the one expected. The client has already shown it is alive by
+// sending it, so all that is left is to allow the next PING.
+func (h *Hub) pongCommand(sender *session, args []string) {
+	if len(args) != 1 || args[0] != sender.pingToken {
+		// Answers that come too late are no cause for complaint
+		return
+	}
+	sender.pingToken = ""
+	h.stats.pongsReceived.Add(1)
+}
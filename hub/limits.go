@@ -0,0 +1,134 @@
+package hub
+
+import (
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+)
+
+// Limits a client can run into, as used in the rejection metrics
+const (
+	limitTotal   = "total"
+	limitAddress = "address"
+	limitSubnet  = "subnet"
+)
+
+// What a client is told when it runs into a limit
+var limitReasons = map[string]string{
+	limitTotal:   "the server is full, please try again later",
+	limitAddress: "there are too many connections from your address, please try again later",
+	limitSubnet:  "there are too many connections from your network, please try again later",
+}
+
+// connectionLimits counts the clients that are connected, in total and per
+// remote address and subnet, from the moment they are accepted until their
+// connection is closed. It is safe for concurrent use.
+type connectionLimits struct {
+	maxTotal      int // 0 for no limit, like the others
+	maxPerAddress int
+	maxPerSubnet  int
+	ipv4Bits      int // Length of the prefix that makes up an IPv4 subnet
+	ipv6Bits      int
+	lock          sync.Mutex
+	total         int
+	perAddress    map[netip.Addr]int
+	perSubnet     map[netip.Prefix]int
+}
+
+func newConnectionLimits(cfg Config) *connectionLimits {
+	return &connectionLimits{
+		maxTotal:      cfg.MaxConnections,
+		maxPerAddress: cfg.MaxConnectionsPerIP,
+		maxPerSubnet:  cfg.MaxConnectionsPerSubnet,
+		ipv4Bits:      cfg.SubnetPrefixIPv4,
+		ipv6Bits:      cfg.SubnetPrefixIPv6,
+		perAddress:    make(map[netip.Addr]int),
+		perSubnet:     make(map[netip.Prefix]int),
+	}
+}
+
+// acquire counts a client connecting from address, unless that would take it
+// over a limit, in which case it returns the limit. Clients that do not
+// connect over IP only count towards the total.
+func (l *connectionLimits) acquire(address netip.Addr) string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.maxTotal > 0 && l.total >= l.maxTotal {
+		return limitTotal
+	}
+	if !address.IsValid() {
+		l.total++
+		return ""
+	}
+	subnet := l.subnet(address)
+	if l.maxPerAddress > 0 && l.perAddress[address] >= l.maxPerAddress {
+		return limitAddress
+	}
+	if l.maxPerSubnet > 0 && l.perSubnet[subnet] >= l.maxPerSubnet {
+		return limitSubnet
+	}
+	l.total++
+	l.perAddress[address]++
+	l.perSubnet[subnet]++
+	return ""
+}
+
+// release stops counting a client that acquire counted.
+func (l *connectionLimits) release(address netip.Addr) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.total--
+	if !address.IsValid() {
+		return
+	}
+	subnet := l.subnet(address)
+	if l.perAddress[address]--; l.perAddress[address] <= 0 {
+		delete(l.perAddress, address)
+	}
+	if l.perSubnet[subnet]--; l.perSubnet[subnet] <= 0 {
+		delete(l.perSubnet, subnet)
+	}
+}
+
+// connected returns the number of clients being counted.
+func (l *connectionLimits) connected() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.total
+}
+
+func (l *connectionLimits) subnet(address netip.Addr) netip.Prefix {
+	bits := l.ipv6Bits
+	if address.Is4() {
+		bits = l.ipv4Bits
+	}
+	subnet, _ := address.Prefix(bits)
+	return subnet
+}
+
+// countConnection counts a client connecting from remote against the
+// connection limits. It returns the function that stops counting the client,
+// which may be called more than once, or the limit the client is over.
+func (h *Hub) countConnection(remote net.Addr) (func(), string) {
+	address := remoteAddress(remote)
+	if limit := h.limits.acquire(address); limit != "" {
+		h.stats.limitRejections[limit].Add(1)
+		log.Printf("Rejecting %v, over the %s connection limit", remote, limit)
+		return nil, limit
+	}
+	var once sync.Once
+	return func() { once.Do(func() { h.limits.release(address) }) }, ""
+}
+
+// limitedTransport stops counting its client against the connection limits
+// once it is closed.
+type limitedTransport struct {
+	Transport
+	release func()
+}
+
+func (t *limitedTransport) Close() error {
+	t.release()
+	return t.Transport.Close()
+}
@@ -0,0 +1,71 @@
+package hub
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestConnectionLimits(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxConnections = 5
+	cfg.MaxConnectionsPerIP = 2
+	cfg.MaxConnectionsPerSubnet = 3
+	limits := newConnectionLimits(cfg)
+	steps := []struct {
+		address string // Empty for a client that does not connect over IP
+		release bool
+		limit   string
+	}{
+		{address: "192.0.2.1"},
+		{address: "192.0.2.1"},
+		{address: "192.0.2.1", limit: limitAddress},
+		{address: "192.0.2.2"},
+		// Every address in 192.0.2.0/24 counts towards the subnet
+		{address: "192.0.2.3", limit: limitSubnet},
+		{address: "::ffff:192.0.2.3", limit: limitSubnet},
+		{address: "198.51.100.1"},
+		{address: "2001:db8::1"},
+		{address: "2001:db8::2", limit: limitTotal},
+		{address: "", limit: limitTotal},
+		// Leaving makes room again
+		{address: "192.0.2.1", release: true},
+		{address: "192.0.2.3"},
+		{address: "2001:db8::2", limit: limitTotal},
+		{address: "2001:db8::1", release: true},
+		{address: ""},
+		{address: "", release: true},
+		{address: "2001:db8::2"},
+	}
+	for i, step := range steps {
+		var address netip.Addr
+		if step.address != "" {
+			address = netip.MustParseAddr(step.address).Unmap()
+		}
+		if step.release {
+			limits.release(address)
+			continue
+		}
+		if limit := limits.acquire(address); limit != step.limit {
+			t.Fatalf("step %d: acquire(%q) = %q, want %q", i, step.address, limit, step.limit)
+		}
+	}
+	if connected := limits.connected(); connected != 5 {
+		t.Errorf("connected() = %d, want 5", connected)
+	}
+}
+
+func TestConnectionLimitsRelease(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxConnectionsPerIP = 1
+	limits := newConnectionLimits(cfg)
+	address := netip.MustParseAddr("192.0.2.1")
+	for range 3 {
+		if limit := limits.acquire(address); limit != "" {
+			t.Fatalf("acquire() = %q after the last client left", limit)
+		}
+		limits.release(address)
+	}
+	if len(limits.perAddress) != 0 || len(limits.perSubnet) != 0 || limits.connected() != 0 {
+		t.Errorf("limits still count clients after every one left: %+v", limits)
+	}
+}
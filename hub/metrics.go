@@ -0,0 +1,150 @@
+package hub
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// hubSnapshot is the part of the hub's state that only the hub's goroutine
+// can look at, copied for the metrics handler.
+type hubSnapshot struct {
+	sessions        int
+	rooms           int
+	queuedMessages  int // Messages waiting in all outbound queues together
+	deepestQueue    int
+	operators       int
+	mutedSessions   int
+	historyMessages int
+	subscriptions   int
+}
+
+func (h *Hub) snapshot() hubSnapshot {
+	snapshot := hubSnapshot{sessions: len(h.connections), rooms: len(h.rooms)}
+	now := time.Now()
+	for _, s := range h.connections {
+		depth := len(s.outbound)
+		snapshot.queuedMessages += depth
+		if depth > snapshot.deepestQueue {
+			snapshot.deepestQueue = depth
+		}
+		if s.operator {
+			snapshot.operators++
+		}
+		if now.Before(s.mutedUntil) {
+			snapshot.mutedSessions++
+		}
+		snapshot.subscriptions += len(s.subscriptions)
+	}
+	for _, history := range h.history {
+		snapshot.historyMessages += len(history.entries)
+	}
+	return snapshot
+}
+
+// MetricsHandler serves the hub's metrics in the Prometheus text format.
+func (h *Hub) MetricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		reply := make(chan hubSnapshot, 1)
+		select {
+		case h.snapshots <- reply:
+			snapshot := <-reply
+			writeMetric(w, "tcpserver_sessions", "gauge", "Connected sessions.", snapshot.sessions)
+			writeMetric(w, "tcpserver_rooms", "gauge", "Rooms with at least one member.", snapshot.rooms)
+			writeMetric(w, "tcpserver_outbound_queued_messages", "gauge",
+				"Messages waiting in outbound queues.", snapshot.queuedMessages)
+			writeMetric(w, "tcpserver_outbound_queue_max_depth", "gauge",
+				"Messages waiting in the fullest outbound queue.", snapshot.deepestQueue)
+			writeMetric(w, "tcpserver_outbound_queue_capacity", "gauge",
+				"Messages that fit in one outbound queue.", h.cfg.OutboundQueueSize)
+			writeMetric(w, "tcpserver_operators", "gauge", "Sessions with operator rights.", snapshot.operators)
+			writeMetric(w, "tcpserver_muted_sessions", "gauge", "Sessions that have been muted.", snapshot.mutedSessions)
+			writeMetric(w, "tcpserver_history_messages", "gauge",
+				"Messages kept in room histories.", snapshot.historyMessages)
+			writeMetric(w, "tcpserver_topic_subscriptions", "gauge",
+				"Topic filters that sessions are subscribed to.", snapshot.subscriptions)
+		case <-time.After(time.Second):
+			// The hub is busy or shutting down, so make do with the counters
+		}
+		stats := &h.stats
+		writeMetric(w, "tcpserver_messages_received_total", "counter",
+			"Lines received from clients.", stats.messagesReceived.Load())
+		writeMetric(w, "tcpserver_received_bytes_total", "counter",
+			"Bytes of lines received from clients.", stats.bytesReceived.Load())
+		writeMetric(w, "tcpserver_messages_sent_total", "counter", "Lines sent to clients.", stats.messagesSent.Load())
+		writeMetric(w, "tcpserver_sent_bytes_total", "counter", "Bytes sent to clients.", stats.bytesSent.Load())
+		writeMetric(w, "tcpserver_filter_hits_total", "counter",
+			"Messages that a content filter objected to.", stats.filterHits.Load())
+		writeMetric(w, "tcpserver_dropped_messages_total", "counter",
+			"Messages dropped because an outbound queue was full.", stats.droppedMessages.Load())
+		writeMetric(w, "tcpserver_slow_consumer_disconnects_total", "counter",
+			"Sessions disconnected because their outbound queue was full.", stats.slowConsumerDisconnects.Load())
+		writeMetric(w, "tcpserver_write_timeouts_total", "counter",
+			"Writes to clients that timed out.", stats.writeTimeouts.Load())
+		writeMetric(w, "tcpserver_flood_penalties_total", "counter",
+			"Lines that went over a session's rate limits.", stats.floodPenalties.Load())
+		writeMetric(w, "tcpserver_pings_sent_total", "counter", "PINGs sent to silent clients.", stats.pingsSent.Load())
+		writeMetric(w, "tcpserver_pongs_received_total", "counter",
+			"PINGs that clients answered in time.", stats.pongsReceived.Load())
+		writeMetric(w, "tcpserver_idle_disconnects_total", "counter",
+			"Sessions disconnected for being silent too long.", stats.idleDisconnects.Load())
+		writeMetric(w, "tcpserver_connections", "gauge",
+			"Connected clients, counting those still logging in.", h.limits.connected())
+		name := "tcpserver_limit_rejections_total"
+		fmt.Fprintf(w, "# HELP %s Clients turned away for going over a connection limit.\n# TYPE %s counter\n", name, name)
+		for _, limit := range []string{limitTotal, limitAddress, limitSubnet} {
+			fmt.Fprintf(w, "%s{limit=%q} %d\n", name, limit, stats.limitRejections[limit].Load())
+		}
+		writeMetric(w, "tcpserver_temporary_accept_errors_total", "counter",
+			"Accept errors that were retried.", stats.temporaryAcceptErrors.Load())
+		writeMetric(w, "tcpserver_permanent_accept_errors_total", "counter",
+			"Accept errors that shut the server down.", stats.permanentAcceptErrors.Load())
+		stats.writeLatency.write(w, "tcpserver_write_latency_seconds", "Time taken to write a message to a client.")
+	})
+	return mux
+}
+
+// writeMetric writes a single-valued metric in the Prometheus text format.
+func writeMetric[T int | int64](w io.Writer, name, metricType, help string, value T) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, metricType, name, value)
+}
+
+// Upper bounds, in seconds, of the write latency histogram's buckets
+var writeLatencyBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10}
+
+// histogram counts durations in buckets, the way Prometheus expects. It is
+// safe for concurrent use.
+type histogram struct {
+	bounds []float64      // Upper bounds of the buckets, in seconds
+	counts []atomic.Int64 // Observations per bucket, the last one for anything longer
+	sum    atomic.Int64   // Nanoseconds observed in total
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]atomic.Int64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	bucket := sort.SearchFloat64s(h.bounds, d.Seconds())
+	h.counts[bucket].Add(1)
+	h.sum.Add(int64(d))
+}
+
+// write writes the histogram in the Prometheus text format, where every
+// bucket also counts the observations in the buckets below it.
+func (h *histogram) write(w io.Writer, name, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	var cumulative int64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i].Load()
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound, cumulative)
+	}
+	cumulative += h.counts[len(h.bounds)].Load()
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, cumulative)
+	fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", name, time.Duration(h.sum.Load()).Seconds(), name, cumulative)
+}
@@ -0,0 +1,339 @@
+package hub
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// isMuted tells a muted session that it cannot speak, and reports whether it
+// is muted.
+func (h *Hub) isMuted(s *session) bool {
+	if s.mutedUntil.IsZero() {
+		return false
+	}
+	if time.Now().After(s.mutedUntil) {
+		s.mutedUntil = time.Time{}
+		return false
+	}
+	if !h.notice {
+		h.reply(s, "Error: you have been muted")
+	}
+	return true
+}
+
+// operCommand handles "/OPER <password>".
+func (h *Hub) operCommand(sender *session, args []string) {
+	if len(args) != 1 {
+		h.reply(sender, "Usage: /OPER <password>")
+		return
+	}
+	if h.cfg.OperatorPassword == "" ||
+		subtle.ConstantTimeCompare([]byte(args[0]), []byte(h.cfg.OperatorPassword)) != 1 {
+		log.Printf("Session %d (%s) failed to become an operator", sender.id, sender.nick)
+		h.reply(sender, "Error: wrong operator password")
+		return
+	}
+	log.Printf("Session %d (%s) is now an operator", sender.id, sender.nick)
+	sender.operator = true
+	h.reply(sender, "* you are now an operator")
+}
+
+// moderatorCommand carries out the commands reserved for operators:
+//
+//	/KICK <nick> [reason]
+//	/BAN <nick|address|network> [duration] [reason]
+//	/UNBAN <address|network|account>
+//	/BANS
+//	/MUTE <nick> [duration]
+//	/UNMUTE <nick>
+func (h *Hub) moderatorCommand(sender *session, name string, args []string, line []byte) {
+	if name == "BANS" {
+		h.listBans(sender)
+		return
+	}
+	if len(args) == 0 {
+		h.reply(sender, "Error: /"+name+" needs someone to act on")
+		return
+	}
+	if name == "UNBAN" {
+		if h.bans.remove(args[0]) {
+			h.saveBans()
+			h.reply(sender, "* unbanned "+args[0])
+		} else {
+			h.reply(sender, "Error: "+args[0]+" is not banned")
+		}
+		return
+	}
+
+	// Everything else takes an optional duration after the target, and the
+	// rest of the line is the reason
+	var length time.Duration
+	reasonStart := 2 // Fields before the reason, counting the command
+	if len(args) > 1 && name != "KICK" {
+		if parsed, err := time.ParseDuration(args[1]); err == nil && parsed > 0 {
+			length = parsed
+			reasonStart = 3
+		}
+	}
+	reason := commandRest(line, reasonStart)
+	target := h.nicks[strings.ToLower(args[0])]
+
+	switch name {
+	case "KICK":
+		if target == nil {
+			h.fail(sender, 401, args[0], "there is no one called "+args[0]+" here")
+			return
+		}
+		h.kick(target, fmt.Sprintf("kicked by %s%s", sender.nick, formatReason(reason)))
+	case "BAN":
+		h.ban(sender, args[0], target, length, reason)
+	case "MUTE", "UNMUTE":
+		if target == nil {
+			h.fail(sender, 401, args[0], "there is no one called "+args[0]+" here")
+			return
+		}
+		if name == "UNMUTE" {
+			target.mutedUntil = time.Time{}
+			h.reply(target, "* you may speak again")
+			h.reply(sender, "* unmuted "+target.nick)
+			return
+		}
+		// A mute without a duration lasts as long as the session
+		target.mutedUntil = time.Now().Add(100 * 365 * 24 * time.Hour)
+		if length > 0 {
+			target.mutedUntil = time.Now().Add(length)
+		}
+		log.Printf("%s muted %s until %v", sender.nick, target.nick, target.mutedUntil)
+		h.reply(target, "* you have been muted by "+sender.nick)
+		h.reply(sender, "* muted "+target.nick)
+	}
+}
+
+// ban bans a nick, address or network, disconnecting everyone it covers. A
+// nick bans the session's address, and its account if it has one.
+func (h *Hub) ban(sender *session, what string, target *session, length time.Duration, reason string) {
+	newBan := ban{By: sender.nick, Reason: reason}
+	if length > 0 {
+		newBan.Expires = time.Now().Add(length)
+	}
+	if target != nil {
+		newBan.Network = netip.PrefixFrom(target.address, target.address.BitLen())
+		newBan.Account = target.account
+	} else if network, err := parseNetwork(what); err == nil {
+		newBan.Network = network
+	} else {
+		h.reply(sender, "Error: "+what+" is neither a nick, an address nor a network")
+		return
+	}
+	h.bans.add(newBan)
+	h.saveBans()
+	log.Printf("%s banned %s", sender.nick, newBan.describe())
+	h.reply(sender, "* banned "+newBan.describe())
+
+	for _, s := range h.connections {
+		if s == sender {
+			continue
+		}
+		if newBan.Network.Contains(s.address) || (newBan.Account != "" && newBan.Account == s.account) {
+			h.kick(s, fmt.Sprintf("banned by %s%s", sender.nick, formatReason(reason)))
+		}
+	}
+}
+
+// kick disconnects a session, telling it and those who share a room with it
+// why.
+func (h *Hub) kick(target *session, why string) {
+	notice := fmt.Sprintf("* %s was %s", target.nick, why)
+	for _, recipient := range h.roomAudience(target) {
+		h.reply(recipient, notice)
+	}
+	h.reply(target, "* you were "+why)
+	h.removeSession(target.id)
+}
+
+// listBans tells an operator which bans are in force.
+func (h *Hub) listBans(recipient *session) {
+	bans := h.bans.list()
+	if len(bans) == 0 {
+		h.reply(recipient, "* nobody is banned")
+		return
+	}
+	for _, b := range bans {
+		h.reply(recipient, "* "+b.describe())
+	}
+}
+
+// saveBans writes the bans to the ban file, if there is one.
+func (h *Hub) saveBans() {
+	if err := h.bans.save(); err != nil {
+		log.Print("Failed to save bans: ", err)
+	}
+}
+
+// formatReason turns an optional reason into something to tack onto a
+// sentence.
+func formatReason(reason string) string {
+	if reason == "" {
+		return ""
+	}
+	return " (" + reason + ")"
+}
+
+// ban keeps a network, and optionally an account, from connecting.
+type ban struct {
+	Network netip.Prefix `json:"network"`
+	Account string       `json:"account,omitempty"`
+	Expires time.Time    `json:"expires,omitzero"` // Zero for a ban that never expires
+	By      string       `json:"by"`
+	Reason  string       `json:"reason,omitempty"`
+}
+
+func (b ban) expired(now time.Time) bool {
+	return !b.Expires.IsZero() && now.After(b.Expires)
+}
+
+// describe sums a ban up in a line of text.
+func (b ban) describe() string {
+	description := b.Network.String()
+	if b.Account != "" {
+		description += " and account " + b.Account
+	}
+	if b.Expires.IsZero() {
+		description += " for good"
+	} else {
+		description += " until " + b.Expires.Format(time.RFC3339)
+	}
+	return description + ", by " + b.By + formatReason(b.Reason)
+}
+
+// describeReason returns the reason for a ban, to tack onto a sentence.
+func (b ban) describeReason() string {
+	return formatReason(b.Reason)
+}
+
+// banList holds the bans in force. The accept loop checks it while the hub
+// changes it, so it is guarded by a mutex.
+type banList struct {
+	file  string // Where the bans are saved, empty to not save them
+	mutex sync.Mutex
+	bans  []ban
+}
+
+// loadBanList reads the bans saved in file. A missing file holds no bans.
+func loadBanList(file string) (*banList, error) {
+	l := &banList{file: file}
+	if file == "" {
+		return l, nil
+	}
+	content, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &l.bans); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", file, err)
+	}
+	return l, nil
+}
+
+// save writes the bans to the ban file, leaving out expired ones.
+func (l *banList) save() error {
+	if l.file == "" {
+		return nil
+	}
+	content, err := json.MarshalIndent(l.list(), "", "  ")
+	if err != nil {
+		return err
+	}
+	temporary := l.file + ".tmp"
+	if err := os.WriteFile(temporary, content, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(temporary, l.file)
+}
+
+// list returns the bans that have not expired, forgetting the rest.
+func (l *banList) list() []ban {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	current := l.bans[:0]
+	for _, b := range l.bans {
+		if !b.expired(now) {
+			current = append(current, b)
+		}
+	}
+	l.bans = current
+	return append(make([]ban, 0, len(current)), current...)
+}
+
+func (l *banList) add(b ban) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.bans = append(l.bans, b)
+}
+
+// remove lifts the bans on an address, network or account, and reports
+// whether there were any.
+func (l *banList) remove(what string) bool {
+	network, err := parseNetwork(what)
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	kept := l.bans[:0]
+	for _, b := range l.bans {
+		if (err == nil && b.Network == network) || b.Account == what {
+			continue
+		}
+		kept = append(kept, b)
+	}
+	removed := len(kept) < len(l.bans)
+	l.bans = kept
+	return removed
+}
+
+// matchAddress returns the ban covering an address, or nil if there is none.
+func (l *banList) matchAddress(address netip.Addr) *ban {
+	return l.match(func(b ban) bool { return b.Network.Contains(address) })
+}
+
+// matchAccount returns the ban on an account, or nil if there is none.
+func (l *banList) matchAccount(account string) *ban {
+	return l.match(func(b ban) bool { return b.Account == account })
+}
+
+func (l *banList) match(matches func(ban) bool) *ban {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	for _, b := range l.bans {
+		if !b.expired(now) && matches(b) {
+			return &b
+		}
+	}
+	return nil
+}
+
+// parseNetwork parses an address or a network in CIDR notation. An address is
+// taken as a network holding just that address.
+func parseNetwork(text string) (netip.Prefix, error) {
+	if strings.Contains(text, "/") {
+		network, err := netip.ParsePrefix(text)
+		return network.Masked(), err
+	}
+	address, err := netip.ParseAddr(text)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	address = address.Unmap()
+	return netip.PrefixFrom(address, address.BitLen()), nil
+}
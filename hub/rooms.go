@@ -0,0 +1,153 @@
+package hub
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// roomAudience returns everyone other than s who shares a room with s. A
+// session that shares several rooms with s is only included once.
+func (h *Hub) roomAudience(s *session) map[int]*session {
+	audience := make(map[int]*session)
+	for room := range s.rooms {
+		for id, member := range h.rooms[room] {
+			if id != s.id {
+				audience[id] = member
+			}
+		}
+	}
+	return audience
+}
+
+// joinRoom adds a session to a room, creating the room if needed.
+func (h *Hub) joinRoom(s *session, room string) {
+	if s.rooms[room] {
+		h.reply(s, "Error: you are already in "+room)
+		return
+	}
+	if h.rooms[room] == nil {
+		h.rooms[room] = make(map[int]*session)
+	}
+	h.rooms[room][s.id] = s
+	s.rooms[room] = true
+	for id, member := range h.rooms[room] {
+		joined := event{kind: eventJoin, room: room, sender: s.nick}
+		if id == s.id {
+			// Tell the newcomer who is already there
+			joined.names = h.roomNames(room)
+		}
+		h.send(member, joined)
+	}
+	h.replayHistory(s, room, 1)
+}
+
+// partRoom removes a session from a room. Rooms are forgotten once empty.
+func (h *Hub) partRoom(s *session, room string) {
+	if !s.rooms[room] {
+		h.fail(s, 442, room, "you are not in "+room)
+		return
+	}
+	h.notifyRoom(room, event{kind: eventPart, room: room, sender: s.nick})
+	delete(h.rooms[room], s.id)
+	delete(s.rooms, room)
+	if len(h.rooms[room]) == 0 {
+		delete(h.rooms, room)
+	}
+}
+
+// listRooms tells a session which rooms exist and how many members they have.
+func (h *Hub) listRooms(recipient *session) {
+	if len(h.rooms) == 0 {
+		h.reply(recipient, "There are no rooms")
+		return
+	}
+	names := make([]string, 0, len(h.rooms))
+	for room := range h.rooms {
+		names = append(names, room)
+	}
+	sort.Strings(names)
+	for _, room := range names {
+		h.reply(recipient, fmt.Sprintf("%s: %d members", room, len(h.rooms[room])))
+	}
+}
+
+// roomNames returns the nicks of the members of a room, sorted.
+func (h *Hub) roomNames(room string) []string {
+	names := make([]string, 0, len(h.rooms[room]))
+	for _, member := range h.rooms[room] {
+		names = append(names, member.nick)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// changeNick renames a session and tells everyone sharing a room with it.
+func (h *Hub) changeNick(s *session, nick string) {
+	if owner, taken := h.nicks[strings.ToLower(nick)]; (taken && owner != s) || h.isBotName(nick) {
+		h.fail(s, 433, nick, "the nick "+nick+" is already in use")
+		return
+	}
+	renamed := event{kind: eventNick, sender: s.nick, target: nick}
+	h.setNick(s, nick)
+	h.send(s, renamed)
+	for _, recipient := range h.roomAudience(s) {
+		h.send(recipient, renamed)
+	}
+}
+
+// setNick gives a session a nick, releasing the one it had before. The caller
+// must make sure the nick is free.
+func (h *Hub) setNick(s *session, nick string) {
+	if s.nick != "" {
+		delete(h.nicks, strings.ToLower(s.nick))
+	}
+	s.nick = nick
+	h.nicks[strings.ToLower(nick)] = s
+}
+
+// initialNick picks the nick a new session starts out with. Clients that have
+// proven their identity get that as their nick, as long as it is valid and
+// free. Everyone else gets the nick they asked for if they can have it, and is
+// a guest otherwise.
+func (h *Hub) initialNick(s *session, verifiedNick string, wantedNick string) string {
+	if verifiedNick == "" && wantedNick != "" {
+		if nickPattern.MatchString(wantedNick) && h.nicks[strings.ToLower(wantedNick)] == nil && !h.isBotName(wantedNick) {
+			return wantedNick
+		}
+		h.reply(s, "* the nick "+wantedNick+" cannot be used, you are a guest instead")
+	}
+	if verifiedNick == "" {
+		return h.guestNick(s.id)
+	}
+	if !nickPattern.MatchString(verifiedNick) {
+		h.reply(s, "* your name "+verifiedNick+" cannot be used as a nick")
+		return h.guestNick(s.id)
+	}
+	if h.nicks[strings.ToLower(verifiedNick)] != nil || h.isBotName(verifiedNick) {
+		h.reply(s, "* your name "+verifiedNick+" is already in use")
+		return h.guestNick(s.id)
+	}
+	return verifiedNick
+}
+
+// guestNick generates a free nick for a new session.
+func (h *Hub) guestNick(id int) string {
+	nick := fmt.Sprintf("guest%d", id)
+	for suffix := 1; h.nicks[strings.ToLower(nick)] != nil; suffix++ {
+		nick = fmt.Sprintf("guest%d-%d", id, suffix)
+	}
+	return nick
+}
+
+var nickPattern = regexp.MustCompile("^[A-Za-z][A-Za-z0-9_-]{0,15}$")
+
+var roomNamePattern = regexp.MustCompile("^[a-z0-9_.-]{1,32}$")
+
+// normalizeRoomName lower-cases a room name and strips an optional leading
+// "#". It reports whether the result is a valid room name.
+func normalizeRoomName(name string) (string, bool) {
+	name = strings.ToLower(strings.TrimPrefix(name, "#"))
+	return name, roomNamePattern.MatchString(name)
+}
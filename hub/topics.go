@@ -0,0 +1,177 @@
+package hub
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Limits on topics, to keep the topic tree from growing without bounds
+const (
+	maxTopicLength   = 256
+	maxSubscriptions = 100 // Per session
+)
+
+// topicNode is a level of the topic tree. Topics are split into levels at
+// "/", and sessions subscribe to topic filters, which may use the MQTT
+// wildcards: "+" matches any one level, and "#" as the last level matches any
+// number of levels, including none.
+type topicNode struct {
+	children    map[string]*topicNode
+	subscribers map[int]*session // Sessions subscribed to the filter ending here
+}
+
+// subscribe adds a session to the filter made of levels.
+func (n *topicNode) subscribe(levels []string, s *session) {
+	for _, level := range levels {
+		if n.children == nil {
+			n.children = make(map[string]*topicNode)
+		}
+		child := n.children[level]
+		if child == nil {
+			child = &topicNode{}
+			n.children[level] = child
+		}
+		n = child
+	}
+	if n.subscribers == nil {
+		n.subscribers = make(map[int]*session)
+	}
+	n.subscribers[s.id] = s
+}
+
+// unsubscribe removes a session from the filter made of levels, and prunes
+// the branches nobody is subscribed to any more.
+func (n *topicNode) unsubscribe(levels []string, s *session) {
+	if len(levels) == 0 {
+		delete(n.subscribers, s.id)
+		return
+	}
+	child := n.children[levels[0]]
+	if child == nil {
+		return
+	}
+	child.unsubscribe(levels[1:], s)
+	if len(child.subscribers) == 0 && len(child.children) == 0 {
+		delete(n.children, levels[0])
+	}
+}
+
+// match adds the sessions subscribed to a filter matching the topic made of
+// levels to matched. As in MQTT, a wildcard at the first level does not match
+// a topic starting with "$".
+func (n *topicNode) match(levels []string, matched map[int]*session, first bool) {
+	wildcards := !first || !strings.HasPrefix(levels[0], "$")
+	if all := n.children["#"]; all != nil && wildcards {
+		addSubscribers(matched, all)
+	}
+	for _, level := range []string{levels[0], "+"} {
+		child := n.children[level]
+		if child == nil || (level == "+" && !wildcards) {
+			continue
+		}
+		if len(levels) == 1 {
+			addSubscribers(matched, child)
+			// "a/#" matches "a" as well
+			if all := child.children["#"]; all != nil {
+				addSubscribers(matched, all)
+			}
+		} else {
+			child.match(levels[1:], matched, false)
+		}
+	}
+}
+
+func addSubscribers(matched map[int]*session, n *topicNode) {
+	for id, s := range n.subscribers {
+		matched[id] = s
+	}
+}
+
+// validTopic reports whether a topic, or a topic filter if filter is set, is
+// well formed.
+func validTopic(topic string, filter bool) bool {
+	if topic == "" || len(topic) > maxTopicLength || strings.ContainsAny(topic, " \t\r\n") {
+		return false
+	}
+	levels := strings.Split(topic, "/")
+	for i, level := range levels {
+		if !strings.ContainsAny(level, "+#") {
+			continue
+		}
+		if !filter || (level != "+" && level != "#") || (level == "#" && i != len(levels)-1) {
+			return false
+		}
+	}
+	return true
+}
+
+// subscribeCommand handles "/SUB [filter]", which subscribes the sender to a
+// topic filter, or lists its subscriptions if none is given.
+func (h *Hub) subscribeCommand(sender *session, args []string) {
+	if len(args) == 0 {
+		if len(sender.subscriptions) == 0 {
+			h.reply(sender, "* you are not subscribed to anything")
+			return
+		}
+		filters := make([]string, 0, len(sender.subscriptions))
+		for filter := range sender.subscriptions {
+			filters = append(filters, filter)
+		}
+		sort.Strings(filters)
+		h.reply(sender, "* you are subscribed to "+strings.Join(filters, ", "))
+		return
+	}
+	if len(args) != 1 || !validTopic(args[0], true) {
+		h.reply(sender, "Error: a topic filter is levels separated by '/', with '+' for any one level and a final '#' for any number of levels")
+		return
+	}
+	filter := args[0]
+	if !sender.subscriptions[filter] {
+		if len(sender.subscriptions) >= maxSubscriptions {
+			h.reply(sender, fmt.Sprintf("Error: you cannot subscribe to more than %d topic filters", maxSubscriptions))
+			return
+		}
+		sender.subscriptions[filter] = true
+		h.topics.subscribe(strings.Split(filter, "/"), sender)
+	}
+	h.reply(sender, "* subscribed to "+filter)
+}
+
+// unsubscribeCommand handles "/UNSUB <filter>".
+func (h *Hub) unsubscribeCommand(sender *session, args []string) {
+	if len(args) != 1 {
+		h.reply(sender, "Usage: /UNSUB <topic filter>")
+		return
+	}
+	if !sender.subscriptions[args[0]] {
+		h.reply(sender, "Error: you are not subscribed to "+args[0])
+		return
+	}
+	h.unsubscribe(sender, args[0])
+	h.reply(sender, "* unsubscribed from "+args[0])
+}
+
+func (h *Hub) unsubscribe(s *session, filter string) {
+	delete(s.subscriptions, filter)
+	h.topics.unsubscribe(strings.Split(filter, "/"), s)
+}
+
+// publishTopic runs a message on a topic through the filters and delivers it
+// to every session subscribed to a matching filter, the sender included.
+func (h *Hub) publishTopic(sender *session, topic string, message []byte) {
+	if h.isMuted(sender) {
+		return
+	}
+	message, ok := h.filter(sender, message)
+	if !ok {
+		return
+	}
+	text := strings.TrimSuffix(string(message), "\n")
+	subscribers := make(map[int]*session)
+	h.topics.match(strings.Split(topic, "/"), subscribers, true)
+	for _, subscriber := range subscribers {
+		h.send(subscriber, event{kind: eventTopic, topic: topic, sender: sender.nick, text: text})
+	}
+	h.send(sender, event{kind: eventAck})
+}
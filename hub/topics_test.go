@@ -0,0 +1,129 @@
+package hub
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTopicMatch(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		match  bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/b", "a", false},
+		{"a/b", "a/b/c", false},
+		{"a/+", "a/b", true},
+		{"a/+", "a", false},
+		{"a/+", "a/b/c", false},
+		{"+/b", "a/b", true},
+		{"+/+", "a/b", true},
+		{"+", "a", true},
+		{"a/+/c", "a/b/c", true},
+		{"a/+/c", "a/b/d", false},
+		{"a/#", "a/b", true},
+		{"a/#", "a/b/c", true},
+		{"a/#", "a", true},
+		{"a/#", "b", false},
+		{"a/+/#", "a/b", true},
+		{"a/+/#", "a", false},
+		{"#", "a", true},
+		{"#", "a/b/c", true},
+		{"a/b/#", "a/b", true},
+		{"a//b", "a//b", true},
+		{"a/+/b", "a//b", true},
+		// Wildcards at the first level leave out topics starting with "$"
+		{"#", "$SYS/load", false},
+		{"+/load", "$SYS/load", false},
+		{"$SYS/#", "$SYS/load", true},
+		{"$SYS/+", "$SYS/load", true},
+		{"a/+", "a/$b", true},
+		{"a/#", "a/$b", true},
+	}
+	for _, test := range tests {
+		root := &topicNode{}
+		s := &session{id: 1}
+		root.subscribe(strings.Split(test.filter, "/"), s)
+		matched := make(map[int]*session)
+		root.match(strings.Split(test.topic, "/"), matched, true)
+		if got := matched[s.id] != nil; got != test.match {
+			t.Errorf("filter %q matching topic %q = %v, want %v", test.filter, test.topic, got, test.match)
+		}
+	}
+}
+
+func TestTopicMatchesEachSessionOnce(t *testing.T) {
+	root := &topicNode{}
+	first, second := &session{id: 1}, &session{id: 2}
+	for _, filter := range []string{"a/b", "a/+", "a/#", "#"} {
+		root.subscribe(strings.Split(filter, "/"), first)
+	}
+	root.subscribe([]string{"a", "c"}, second)
+	matched := make(map[int]*session)
+	root.match([]string{"a", "b"}, matched, true)
+	if len(matched) != 1 || matched[first.id] != first {
+		t.Errorf("matched %v, want only session %d", matched, first.id)
+	}
+}
+
+func TestTopicUnsubscribePrunes(t *testing.T) {
+	root := &topicNode{}
+	first, second := &session{id: 1}, &session{id: 2}
+	root.subscribe([]string{"a", "b", "c"}, first)
+	root.subscribe([]string{"a", "+"}, second)
+
+	root.unsubscribe([]string{"a", "b", "c"}, first)
+	if _, ok := root.children["a"].children["b"]; ok {
+		t.Error("branch nobody is subscribed to is still there")
+	}
+	matched := make(map[int]*session)
+	root.match([]string{"a", "b"}, matched, true)
+	if len(matched) != 1 || matched[second.id] != second {
+		t.Errorf("matched %v after unsubscribing, want only session %d", matched, second.id)
+	}
+
+	root.unsubscribe([]string{"a", "+"}, second)
+	if len(root.children) != 0 {
+		t.Errorf("tree still has %d branches after every session unsubscribed", len(root.children))
+	}
+	// Unsubscribing from what nobody subscribed to is harmless
+	root.unsubscribe([]string{"x", "y"}, first)
+}
+
+func TestValidTopic(t *testing.T) {
+	tests := []struct {
+		topic  string
+		filter bool
+		valid  bool
+	}{
+		{"a", false, true},
+		{"a/b/c", false, true},
+		{"$SYS/load", false, true},
+		{"a//b", false, true},
+		{"", false, false},
+		{"", true, false},
+		{"a b", false, false},
+		{"a\tb", true, false},
+		{strings.Repeat("a", maxTopicLength), false, true},
+		{strings.Repeat("a", maxTopicLength+1), false, false},
+		// Wildcards only belong in filters
+		{"a/+", false, false},
+		{"a/#", false, false},
+		{"a/+", true, true},
+		{"+/+", true, true},
+		{"a/#", true, true},
+		{"#", true, true},
+		// And only as whole levels, with "#" last
+		{"a/b+", true, false},
+		{"a/#b", true, false},
+		{"a/#/b", true, false},
+		{"##", true, false},
+	}
+	for _, test := range tests {
+		if got := validTopic(test.topic, test.filter); got != test.valid {
+			t.Errorf("validTopic(%q, %v) = %v, want %v", test.topic, test.filter, got, test.valid)
+		}
+	}
+}
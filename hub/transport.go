@@ -0,0 +1,104 @@
+package hub
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// Transport carries lines of text between the hub and one client. The hub
+// reads from a transport on one goroutine while writing to it on another.
+type Transport interface {
+	// ReadLine returns the next line from the client with a single "\n"
+	// terminator. A line that is too long is discarded, and ErrLineTooLong
+	// returned instead.
+	ReadLine() ([]byte, error)
+	// Write sends text to the client, usually one or more whole lines.
+	Write(text []byte) error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	RemoteAddr() net.Addr
+	Close() error
+}
+
+// ErrLineTooLong is returned by Transport.ReadLine for a line that was too
+// long to accept.
+var ErrLineTooLong = errors.New("line too long")
+
+// streamTransport is a Transport on top of a stream connection, with lines
+// terminated by "\n" or "\r\n".
+type streamTransport struct {
+	net.Conn
+	reader        *bufio.Reader
+	maxLineLength int
+}
+
+// NewStreamTransport returns a Transport that exchanges lines over a stream
+// connection, such as a TCP or TLS connection. Lines longer than
+// maxLineLength bytes are rejected.
+func NewStreamTransport(connection net.Conn, maxLineLength int) Transport {
+	return &streamTransport{
+		Conn: connection,
+		// Leave room for a "\r\n" terminator after a line of maximum length
+		reader:        bufio.NewReaderSize(connection, maxLineLength+2),
+		maxLineLength: maxLineLength,
+	}
+}
+
+func (t *streamTransport) ReadLine() ([]byte, error) {
+	return readLine(t.reader, t.maxLineLength)
+}
+
+func (t *streamTransport) Write(text []byte) error {
+	totalWritten := 0
+	for totalWritten < len(text) {
+		writtenThisCall, err := t.Conn.Write(text[totalWritten:])
+		if err != nil {
+			return err
+		}
+		totalWritten += writtenThisCall
+	}
+	return nil
+}
+
+// readLine reads one line from reader and returns it with a single "\n"
+// terminator. Lines longer than maxLineLength are consumed up to and including
+// their terminator, and ErrLineTooLong is returned instead. An unterminated
+// line at the end of the stream is returned as if it had been terminated.
+func readLine(reader *bufio.Reader, maxLineLength int) ([]byte, error) {
+	line, err := reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		// Skip the rest of the oversized line
+		for err == bufio.ErrBufferFull {
+			_, err = reader.ReadSlice('\n')
+		}
+		if err != nil {
+			return nil, err
+		}
+		return nil, ErrLineTooLong
+	}
+	if err != nil && (err != io.EOF || len(line) == 0) {
+		return nil, err
+	}
+	line = bytes.TrimRight(line, "\r\n")
+	if len(line) > maxLineLength {
+		return nil, ErrLineTooLong
+	}
+	// ReadSlice returns a view of the reader's buffer, so copy the line
+	message := make([]byte, len(line), len(line)+1)
+	copy(message, line)
+	return append(message, '\n'), nil
+}
+
+// remoteAddress returns the IP address a client connects from, or the zero
+// address if it does not connect over IP.
+func remoteAddress(address net.Addr) netip.Addr {
+	if tcpAddress, ok := address.(*net.TCPAddr); ok {
+		return tcpAddress.AddrPort().Addr().Unmap()
+	}
+	return netip.Addr{}
+}
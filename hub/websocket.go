@@ -0,0 +1,320 @@
+package hub
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	_ "embed"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+//go:embed chat.html
+var chatPage []byte
+
+// WebHandler serves a chat page at "/", and lets browsers join the hub as
+// sessions speaking the plain text protocol over the WebSocket endpoint at
+// "/ws". The page finds the endpoint relative to its own address, so the
+// handler can be mounted under a prefix with http.StripPrefix.
+func (h *Hub) WebHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write(chatPage)
+	})
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		transport, err := upgradeWebSocket(w, r, h.cfg.MaxLineLength)
+		if err != nil {
+			log.Printf("WebSocket handshake with %v failed: %v", r.RemoteAddr, err)
+			return
+		}
+		var verifiedNick string
+		if r.TLS != nil {
+			verifiedNick = certificateNick(*r.TLS)
+		}
+		h.attach(transport, textProtocol{}, verifiedNick)
+	})
+	return mux
+}
+
+// WebSocket opcodes (RFC 6455, section 5.2)
+const (
+	websocketContinuation = 0x0
+	websocketText         = 0x1
+	websocketBinary       = 0x2
+	websocketClose        = 0x8
+	websocketPing         = 0x9
+	websocketPong         = 0xa
+)
+
+// Appended to a client's key to prove the server understood the handshake
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Longest a control frame may be
+const maxWebsocketControlLength = 125
+
+// Most lines of the maximum length a single message may hold
+const maxWebsocketLines = 16
+
+var errWebsocketProtocol = errors.New("websocket protocol error")
+
+// upgradeWebSocket completes the WebSocket opening handshake for a request,
+// and takes over its connection. If it fails, the client has been told why.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request, maxLineLength int) (*websocketTransport, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	switch {
+	case r.Method != http.MethodGet:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, errors.New("method " + r.Method)
+	case !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket"):
+		http.Error(w, "this is a WebSocket endpoint", http.StatusBadRequest)
+		return nil, errors.New("not a WebSocket upgrade")
+	case r.Header.Get("Sec-WebSocket-Version") != "13":
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("unsupported version " + r.Header.Get("Sec-WebSocket-Version"))
+	case key == "":
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errors.New("missing key")
+	case !sameOrigin(r):
+		// Keep other sites from chatting in the name of their visitors
+		http.Error(w, "cross-origin WebSocket not allowed", http.StatusForbidden)
+		return nil, errors.New("cross-origin request from " + r.Header.Get("Origin"))
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "cannot take over the connection", http.StatusInternalServerError)
+		return nil, errors.New("connection cannot be hijacked")
+	}
+	connection, buffered, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	accept := sha1.Sum([]byte(key + websocketGUID))
+	_ = connection.SetDeadline(time.Time{})
+	_, err = connection.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(accept[:]) + "\r\n\r\n"))
+	if err != nil {
+		_ = connection.Close()
+		return nil, err
+	}
+	return &websocketTransport{Conn: connection, reader: buffered.Reader, maxLineLength: maxLineLength}, nil
+}
+
+// headerHasToken reports whether a comma-separated header holds token, in any
+// case.
+func headerHasToken(header http.Header, name string, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, field := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sameOrigin reports whether a request comes from a page served by the same
+// host, or from something that is not a browser and sends no Origin.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	parsed, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(parsed.Host, r.Host)
+}
+
+// websocketTransport is a Transport over a WebSocket connection. Every text
+// message from the client holds one or more lines, each limited to the
+// maximum length on its own, and everything the hub writes is sent as one
+// text message.
+type websocketTransport struct {
+	net.Conn
+	reader        *bufio.Reader
+	maxLineLength int
+	pending       [][]byte   // Lines from the last message, not read yet
+	writeLock     sync.Mutex // Replies to control frames are written while reading
+	closeSent     bool       // Nothing may follow a close frame, guarded by writeLock
+	closeOnce     sync.Once
+}
+
+func (t *websocketTransport) ReadLine() ([]byte, error) {
+	for len(t.pending) == 0 {
+		message, err := t.readMessage()
+		if err != nil {
+			return nil, err
+		}
+		message = bytes.TrimSuffix(bytes.TrimSuffix(message, []byte("\n")), []byte("\r"))
+		for _, line := range bytes.Split(message, []byte("\n")) {
+			t.pending = append(t.pending, append(bytes.TrimSuffix(line, []byte("\r")), '\n'))
+		}
+	}
+	line := t.pending[0]
+	t.pending = t.pending[1:]
+	if len(line) > t.maxLineLength+1 {
+		return nil, ErrLineTooLong
+	}
+	return line, nil
+}
+
+// readMessage reads frames until it has a whole text or binary message,
+// answering control frames as they come. A message longer than
+// maxWebsocketLines lines of the maximum length is discarded, and
+// ErrLineTooLong returned instead.
+func (t *websocketTransport) readMessage() ([]byte, error) {
+	var message []byte
+	fragmented, tooLong := false, false
+	for {
+		var header [2]byte
+		if _, err := io.ReadFull(t.reader, header[:]); err != nil {
+			return nil, err
+		}
+		final, opcode := header[0]&0x80 != 0, header[0]&0x0f
+		if header[0]&0x70 != 0 {
+			return nil, errWebsocketProtocol // No extension was agreed on to use the RSV bits
+		}
+		if header[1]&0x80 == 0 {
+			return nil, errWebsocketProtocol // Clients must mask what they send
+		}
+		length := uint64(header[1] & 0x7f)
+		switch length {
+		case 126:
+			var extended [2]byte
+			if _, err := io.ReadFull(t.reader, extended[:]); err != nil {
+				return nil, err
+			}
+			length = uint64(binary.BigEndian.Uint16(extended[:]))
+		case 127:
+			var extended [8]byte
+			if _, err := io.ReadFull(t.reader, extended[:]); err != nil {
+				return nil, err
+			}
+			length = binary.BigEndian.Uint64(extended[:])
+			if length>>63 != 0 {
+				return nil, errWebsocketProtocol // The most significant bit must be 0
+			}
+		}
+		var mask [4]byte
+		if _, err := io.ReadFull(t.reader, mask[:]); err != nil {
+			return nil, err
+		}
+
+		if opcode >= websocketClose {
+			if opcode > websocketPong || !final || length > maxWebsocketControlLength {
+				return nil, errWebsocketProtocol
+			}
+			payload, err := t.readPayload(length, mask)
+			if err != nil {
+				return nil, err
+			}
+			switch opcode {
+			case websocketPing:
+				if err := t.writeFrame(websocketPong, payload); err != nil {
+					return nil, err
+				}
+			case websocketClose:
+				// Echo the status code, and expect the hub to hang up
+				_ = t.writeFrame(websocketClose, payload[:min(len(payload), 2)])
+				return nil, io.EOF
+			}
+			continue
+		}
+		if (opcode == websocketContinuation) != fragmented {
+			return nil, errWebsocketProtocol
+		}
+		if opcode != websocketContinuation && opcode != websocketText && opcode != websocketBinary {
+			return nil, errWebsocketProtocol
+		}
+
+		// Each line is checked once the message has been split, this only
+		// keeps the message as a whole from growing without bounds. The
+		// message so far never exceeds the limit, and comparing what is left
+		// of it with the length cannot overflow.
+		if tooLong || length > uint64(maxWebsocketLines*(t.maxLineLength+2)-len(message)) {
+			if _, err := io.CopyN(io.Discard, t.reader, int64(length)); err != nil {
+				return nil, err
+			}
+			tooLong = true
+		} else {
+			payload, err := t.readPayload(length, mask)
+			if err != nil {
+				return nil, err
+			}
+			message = append(message, payload...)
+		}
+		fragmented = true
+		if final {
+			if tooLong {
+				return nil, ErrLineTooLong
+			}
+			return message, nil
+		}
+	}
+}
+
+// readPayload reads and unmasks the payload of a frame.
+func (t *websocketTransport) readPayload(length uint64, mask [4]byte) ([]byte, error) {
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(t.reader, payload); err != nil {
+		return nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return payload, nil
+}
+
+func (t *websocketTransport) Write(text []byte) error {
+	// A message is a line, or several, and needs no terminator of its own
+	text = bytes.TrimSuffix(text, []byte("\n"))
+	return t.writeFrame(websocketText, bytes.ToValidUTF8(text, []byte("\uFFFD")))
+}
+
+// writeFrame sends a whole, unmasked frame.
+func (t *websocketTransport) writeFrame(opcode byte, payload []byte) error {
+	frame := []byte{0x80 | opcode}
+	switch length := len(payload); {
+	case length < 126:
+		frame = append(frame, byte(length))
+	case length <= 0xffff:
+		frame = binary.BigEndian.AppendUint16(append(frame, 126), uint16(length))
+	default:
+		frame = binary.BigEndian.AppendUint64(append(frame, 127), uint64(length))
+	}
+	frame = append(frame, payload...)
+
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+	if t.closeSent {
+		return net.ErrClosed
+	}
+	t.closeSent = opcode == websocketClose
+	_, err := t.Conn.Write(frame)
+	return err
+}
+
+// Close says goodbye with a close frame before closing the connection.
+func (t *websocketTransport) Close() error {
+	err := net.ErrClosed
+	t.closeOnce.Do(func() {
+		_ = t.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+		_ = t.writeFrame(websocketClose, binary.BigEndian.AppendUint16(nil, 1000))
+		err = t.Conn.Close()
+	})
+	return err
+}
@@ -0,0 +1,209 @@
+package hub
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// clientFrame builds a frame the way a client has to send it, masked.
+func clientFrame(final bool, opcode byte, payload string) []byte {
+	first := opcode
+	if final {
+		first |= 0x80
+	}
+	frame := []byte{first}
+	switch length := len(payload); {
+	case length < 126:
+		frame = append(frame, 0x80|byte(length))
+	case length <= 0xffff:
+		frame = binary.BigEndian.AppendUint16(append(frame, 0x80|126), uint16(length))
+	default:
+		frame = binary.BigEndian.AppendUint64(append(frame, 0x80|127), uint64(length))
+	}
+	mask := [4]byte{0x12, 0x34, 0x56, 0x78}
+	frame = append(frame, mask[:]...)
+	for i := range len(payload) {
+		frame = append(frame, payload[i]^mask[i%4])
+	}
+	return frame
+}
+
+// websocketPipe returns a transport reading the frames given, and a channel
+// with everything the transport writes back.
+func websocketPipe(t *testing.T, maxLineLength int, frames ...[]byte) (*websocketTransport, <-chan []byte) {
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	go func() {
+		for _, frame := range frames {
+			if _, err := client.Write(frame); err != nil {
+				return
+			}
+		}
+	}()
+	written := make(chan []byte, 16)
+	go func() {
+		defer close(written)
+		for {
+			buffer := make([]byte, 512)
+			n, err := client.Read(buffer)
+			if err != nil {
+				return
+			}
+			written <- buffer[:n]
+		}
+	}()
+	return &websocketTransport{Conn: server, reader: bufio.NewReader(server), maxLineLength: maxLineLength}, written
+}
+
+func TestWebsocketReadLine(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames [][]byte
+		lines  []string
+	}{
+		{"one line", [][]byte{clientFrame(true, websocketText, "hello")}, []string{"hello\n"}},
+		{"terminated line", [][]byte{clientFrame(true, websocketText, "hello\r\n")}, []string{"hello\n"}},
+		{"binary", [][]byte{clientFrame(true, websocketBinary, "hello")}, []string{"hello\n"}},
+		{"several lines", [][]byte{clientFrame(true, websocketText, "one\r\ntwo\nthree")}, []string{"one\n", "two\n", "three\n"}},
+		{"fragments", [][]byte{
+			clientFrame(false, websocketText, "hel"),
+			clientFrame(false, websocketContinuation, "lo wo"),
+			clientFrame(true, websocketContinuation, "rld"),
+		}, []string{"hello world\n"}},
+		{"ping between fragments", [][]byte{
+			clientFrame(false, websocketText, "hel"),
+			clientFrame(true, websocketPing, "beat"),
+			clientFrame(true, websocketContinuation, "lo"),
+		}, []string{"hello\n"}},
+		{"one message after another", [][]byte{
+			clientFrame(true, websocketText, "first"),
+			clientFrame(true, websocketText, "second"),
+		}, []string{"first\n", "second\n"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transport, _ := websocketPipe(t, 16, test.frames...)
+			for _, want := range test.lines {
+				line, err := transport.ReadLine()
+				if err != nil {
+					t.Fatalf("ReadLine() failed: %v", err)
+				}
+				if string(line) != want {
+					t.Errorf("ReadLine() = %q, want %q", line, want)
+				}
+			}
+		})
+	}
+}
+
+func TestWebsocketPingIsAnswered(t *testing.T) {
+	transport, written := websocketPipe(t, 16,
+		clientFrame(true, websocketPing, "beat"),
+		clientFrame(true, websocketText, "hello"),
+	)
+	if _, err := transport.ReadLine(); err != nil {
+		t.Fatalf("ReadLine() failed: %v", err)
+	}
+	want := []byte{0x80 | websocketPong, 4, 'b', 'e', 'a', 't'}
+	if got := <-written; !bytes.Equal(got, want) {
+		t.Errorf("answer to a ping = %x, want %x", got, want)
+	}
+}
+
+func TestWebsocketLineLimits(t *testing.T) {
+	long := strings.Repeat("x", 17)
+	transport, _ := websocketPipe(t, 16,
+		clientFrame(true, websocketText, "short\n"+long+"\nshort again"),
+		clientFrame(true, websocketText, strings.Repeat(strings.Repeat("y", 16)+"\r\n", maxWebsocketLines)+"y"),
+		clientFrame(true, websocketText, "after"),
+	)
+	expect := func(want string, wantErr error) {
+		t.Helper()
+		line, err := transport.ReadLine()
+		if err != wantErr || (err == nil && string(line) != want) {
+			t.Fatalf("ReadLine() = %q, %v, want %q, %v", line, err, want, wantErr)
+		}
+	}
+	// A line that is too long costs only itself
+	expect("short\n", nil)
+	expect("", ErrLineTooLong)
+	expect("short again\n", nil)
+	// A message that is too long as a whole is dropped entirely
+	expect("", ErrLineTooLong)
+	expect("after\n", nil)
+}
+
+// hugeFrame builds the header of a masked frame claiming a payload of length
+// bytes, without the payload.
+func hugeFrame(final bool, opcode byte, length uint64) []byte {
+	first := opcode
+	if final {
+		first |= 0x80
+	}
+	frame := binary.BigEndian.AppendUint64([]byte{first, 0x80 | 127}, length)
+	return append(frame, 0x12, 0x34, 0x56, 0x78)
+}
+
+func TestWebsocketProtocolErrors(t *testing.T) {
+	unmasked := clientFrame(true, websocketText, "hello")
+	unmasked[1] &^= 0x80
+	reserved := clientFrame(true, websocketText, "hello")
+	reserved[0] |= 0x40
+	tests := []struct {
+		name  string
+		frame []byte
+	}{
+		{"unmasked", unmasked},
+		{"continuation first", clientFrame(true, websocketContinuation, "hello")},
+		{"fragmented control frame", clientFrame(false, websocketPing, "beat")},
+		{"long control frame", clientFrame(true, websocketPing, strings.Repeat("x", maxWebsocketControlLength+1))},
+		{"unknown opcode", clientFrame(true, 0x3, "hello")},
+		{"unknown control opcode", clientFrame(true, 0xb, "hello")},
+		{"reserved bit", reserved},
+		{"length with the top bit set", hugeFrame(true, websocketText, 1<<63)},
+		// The sum of the lengths wraps around to 0
+		{"continuation overflowing the length", append(clientFrame(false, websocketText, "x"),
+			hugeFrame(true, websocketContinuation, 0xffffffffffffffff)...)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transport, _ := websocketPipe(t, 16, test.frame)
+			if _, err := transport.ReadLine(); !errors.Is(err, errWebsocketProtocol) {
+				t.Errorf("ReadLine() error = %v, want %v", err, errWebsocketProtocol)
+			}
+		})
+	}
+}
+
+func TestWebsocketClose(t *testing.T) {
+	transport, written := websocketPipe(t, 16, clientFrame(true, websocketClose, "\x03\xe8bye"))
+	if _, err := transport.ReadLine(); err != io.EOF {
+		t.Fatalf("ReadLine() error = %v, want %v", err, io.EOF)
+	}
+	want := []byte{0x80 | websocketClose, 2, 0x03, 0xe8}
+	if got := <-written; !bytes.Equal(got, want) {
+		t.Errorf("answer to a close = %x, want %x", got, want)
+	}
+	// Nothing may follow the close frame
+	if err := transport.Write([]byte("too late\n")); err == nil {
+		t.Error("Write() after a close frame succeeded")
+	}
+}
+
+func TestWebsocketWrite(t *testing.T) {
+	transport, written := websocketPipe(t, 16)
+	go func() { _ = transport.Write([]byte("one\ntwo\n")) }()
+	want := append([]byte{0x80 | websocketText, 7}, "one\ntwo"...)
+	if got := <-written; !bytes.Equal(got, want) {
+		t.Errorf("written frame = %q, want %q", got, want)
+	}
+}
@@ -1,93 +1,145 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
-	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/pdxiv/goteststuff/hub"
 )
 
-type publishMessage struct {
-	message   []byte
-	sessionID int
+// commandLine holds what was given on the command line besides settings.
+type commandLine struct {
+	dumpConfig bool
+	args       []string // What is left after the flags
 }
 
 func main() {
-	newConnections := make(chan net.Conn, 128)
-	deadConnectionsIDs := make(chan int, 128)
-	publishes := make(chan publishMessage, 128)
-	connections := make(map[int]net.Conn)
-	listener, err := net.Listen("tcp", ":8080")
+	if len(os.Args) > 1 && os.Args[1] == "user" {
+		if err := userCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	cfg, parsed, err := loadConfig("tcpserver", os.Args[1:])
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
 	}
-
-	// New incoming connection
-	go checkForNewIncomingConnections(listener, newConnections)
-	connectionCounter := 0 // Used to generate session IDs
-	for {
-		select {
-		case connection := <-newConnections:
-			connections[connectionCounter] = connection
-			go newConnectionSession(connection, publishes, deadConnectionsIDs, connectionCounter)
-			connectionCounter++
-			log.Print("Number of connections: ", len(connections))
-		case deadConnectionID := <-deadConnectionsIDs:
-			_ = connections[deadConnectionID].Close()
-			delete(connections, deadConnectionID)
-			log.Print("Number of connections: ", len(connections))
-		case publish := <-publishes:
-			if string(publish.message) == "shit\n" {
-				originatorPublish := publishMessage{message: []byte("That's a bad word!!\n"), sessionID: publish.sessionID}
-				go newPublish(originatorPublish, connections[publish.sessionID], deadConnectionsIDs)
-			}
-			for session, connection := range connections {
-				if publish.sessionID != session {
-					go newPublish(publish, connection, deadConnectionsIDs)
-				} else {
-					originatorPublish := publishMessage{message: []byte("Thanks for publishing!\n"), sessionID: publish.sessionID}
-					go newPublish(originatorPublish, connection, deadConnectionsIDs)
-				}
-			}
-		}
+	if len(parsed.args) > 0 {
+		log.Fatalf("unexpected argument %q", parsed.args[0])
 	}
-	listener.Close()
-}
-
-func newPublish(publish publishMessage, connection net.Conn, deadConnectionsIDs chan int) {
-	totalWritten := 0
-	for totalWritten < len(publish.message) {
-		writtenThisCall, err := connection.Write(publish.message[totalWritten:])
+	if parsed.dumpConfig {
+		// The output ends up in terminals and bug reports, so keep secrets out
+		if cfg.OperatorPassword != "" {
+			cfg.OperatorPassword = "REDACTED"
+		}
+		effective, err := json.MarshalIndent(cfg, "", "  ")
 		if err != nil {
-			deadConnectionsIDs <- publish.sessionID
-			break
+			log.Fatal(err)
 		}
-		totalWritten += writtenThisCall
+		fmt.Println(string(effective))
+		return
+	}
+
+	h, err := hub.New(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := h.Start(); err != nil {
+		log.Fatal(err)
 	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case received := <-signals:
+		log.Printf("Received %v, shutting down", received)
+		// A second signal kills the server without waiting for the drain
+		signal.Stop(signals)
+		h.Stop()
+	case <-h.Done():
+	}
+	log.Print("Shutdown complete")
 }
 
-func newConnectionSession(connection net.Conn, publishes chan publishMessage, deadConnectionsIDs chan int, id int) {
-	buf := make([]byte, 1024)
-	// Wait for incoming events
-	for {
-		numberOfBytes, err := connection.Read(buf)
-		if err != nil {
-			deadConnectionsIDs <- id
-			break
-		} else {
-			var messageData publishMessage
-			messageData.message = make([]byte, numberOfBytes)
-			copy(messageData.message, buf[:numberOfBytes])
-			messageData.sessionID = id
-			publishes <- messageData
+// loadConfig builds the effective configuration from the defaults, the
+// config file named by -config and the command line, in increasing order of
+// precedence.
+func loadConfig(name string, arguments []string) (hub.Config, commandLine, error) {
+	cfg := hub.DefaultConfig()
+	var parsed commandLine
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	configFile := flags.String("config", "", "JSON file to read settings from")
+	flags.BoolVar(&parsed.dumpConfig, "dump-config", false, "print the effective configuration as JSON, without secrets, and exit")
+	cfg.BindFlags(flags)
+	if err := flags.Parse(arguments); err != nil {
+		return cfg, parsed, err
+	}
+	parsed.args = flags.Args()
+
+	if *configFile != "" {
+		// The file takes precedence over the defaults, but not over flags
+		// given on the command line, so remember those and set them again
+		explicit := make(map[string]string)
+		flags.Visit(func(f *flag.Flag) {
+			explicit[f.Name] = f.Value.String()
+		})
+		if err := cfg.ReadFile(*configFile); err != nil {
+			return cfg, parsed, err
+		}
+		for name, value := range explicit {
+			if err := flags.Set(name, value); err != nil {
+				return cfg, parsed, err
+			}
 		}
 	}
+	if err := cfg.Validate(); err != nil {
+		return cfg, parsed, err
+	}
+	return cfg, parsed, nil
 }
 
-func checkForNewIncomingConnections(listener net.Listener, newConnections chan net.Conn) {
-	for {
-		connection, err := listener.Accept()
+// userCommand manages the accounts in the credentials file:
+//
+//	tcpserver user [flags] add <name>     (reads the password from standard input)
+//	tcpserver user [flags] remove <name>
+//	tcpserver user [flags] list
+func userCommand(arguments []string) error {
+	cfg, parsed, err := loadConfig("tcpserver user", arguments)
+	if err != nil {
+		return err
+	}
+	if cfg.AuthFile == "" {
+		return errors.New("no credentials file, use -auth-file or -config")
+	}
+	args := parsed.args
+	switch {
+	case len(args) == 2 && args[0] == "add":
+		fmt.Fprint(os.Stderr, "Password: ")
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if password = strings.TrimRight(password, "\r\n"); password == "" && err != nil {
+			return err
+		}
+		return hub.SetPassword(cfg.AuthFile, args[1], password)
+	case len(args) == 2 && args[0] == "remove":
+		return hub.RemoveUser(cfg.AuthFile, args[1])
+	case len(args) == 1 && args[0] == "list":
+		users, err := hub.Users(cfg.AuthFile)
 		if err != nil {
-			panic(err)
+			return err
+		}
+		for _, user := range users {
+			fmt.Println(user)
 		}
-		newConnections <- connection
+		return nil
+	default:
+		return errors.New("usage: tcpserver user [flags] add <name> | remove <name> | list")
 	}
 }